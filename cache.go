@@ -0,0 +1,150 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cacheFile is the content of the cache file, it holds the records of every site of every controller.
+type cacheFile struct {
+	Sites []cachedSite `json:"sites"`
+}
+
+// cachedSite holds the records of one site, the controller is identified by its url and its configured site
+// (controllers can share an url).
+type cachedSite struct {
+	Controller     string         `json:"controller"`
+	ControllerSite string         `json:"controller_site"`
+	Site           string         `json:"site"`
+	Updated        time.Time      `json:"updated"`
+	Domains        []string       `json:"domains"`
+	Records        []cachedRecord `json:"records"`
+}
+
+// cachedRecord is an A or AAAA record.
+type cachedRecord struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// saveCache writes the records to the cache file (if there is one),
+// the file is replaced atomically so a crash never leaves a partial file behind.
+// The records are taken while the writes are serialized, so an older snapshot never replaces a newer one.
+func (p *unifinames) saveCache() error {
+	if p.Config.CacheFile == "" {
+		return nil
+	}
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+
+	var cache cacheFile
+	p.mu.Lock()
+	for id, cfg := range p.Config.Controllers {
+		prefix := recordsKey(id, "")
+		for key, recs := range p.records {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			site := cachedSite{
+				Controller:     cfg.URL,
+				ControllerSite: cfg.Site,
+				Site:           strings.TrimPrefix(key, prefix),
+				Updated:        recs.lastUpdate,
+				Domains:        recs.domains,
+			}
+			for _, rr := range recs.aClients {
+				site.Records = append(site.Records, cachedRecord{Name: rr.Hdr.Name, IP: rr.A.String()})
+			}
+			for _, rr := range recs.aaaaClients {
+				site.Records = append(site.Records, cachedRecord{Name: rr.Hdr.Name, IP: rr.AAAA.String()})
+			}
+			cache.Sites = append(cache.Sites, site)
+		}
+	}
+	p.mu.Unlock()
+
+	buf, err := json.Marshal(&cache)
+	if err != nil {
+		return fmt.Errorf("unable to encode cache: %w", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p.Config.CacheFile), ".unifi-names-")
+	if err != nil {
+		return fmt.Errorf("unable to create cache file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write cache file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("unable to write cache file: %w", err)
+	}
+	if err = os.Rename(f.Name(), p.Config.CacheFile); err != nil {
+		return fmt.Errorf("unable to replace cache file: %w", err)
+	}
+	return nil
+}
+
+// loadCache restores the records from the cache file (if there is one).
+// Sites that are older than the maximum age, or whose controller is no longer configured, are skipped,
+// records that were refreshed already are kept.
+func (p *unifinames) loadCache() error {
+	if p.Config.CacheFile == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(p.Config.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read cache file: %w", err)
+	}
+	var cache cacheFile
+	if err = json.Unmarshal(buf, &cache); err != nil {
+		return fmt.Errorf("unable to decode cache file `%s': %w", p.Config.CacheFile, err)
+	}
+
+	ids := make(map[string]int, len(p.Config.Controllers))
+	for id, cfg := range p.Config.Controllers {
+		ids[cfg.URL+"/"+cfg.Site] = id
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.records == nil {
+		p.records = make(map[string]*records)
+	}
+	var restored int
+	for _, site := range cache.Sites {
+		id, ok := ids[site.Controller+"/"+site.ControllerSite]
+		if !ok || time.Since(site.Updated) >= p.Config.CacheMaxAge {
+			continue
+		}
+		key := recordsKey(id, site.Site)
+		if _, ok := p.records[key]; ok {
+			continue
+		}
+		recs := records{
+			domains:    site.Domains,
+			lastUpdate: site.Updated,
+			refresh:    p.refreshInterval(p.Config.Controllers[id]),
+			restored:   true,
+		}
+		for _, record := range site.Records {
+			recs.addAddress(record.Name, record.IP)
+		}
+		p.records[key] = &recs
+		restored += len(recs.aClients) + len(recs.aaaaClients)
+	}
+	p.updateSerials()
+	log.Printf("[unifi-names] restored %d hosts from `%s'\n", restored, p.Config.CacheFile)
+	return nil
+}
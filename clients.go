@@ -0,0 +1,265 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// client is a client of a unifi site.
+type client struct {
+	MAC     string
+	Name    string
+	Network string
+	IP      string
+	// IPv6Address and IPv6Addresses hold the ipv6 addresses of dual-stack clients (depending on the controller version)
+	IPv6Address   []string `json:"ipv6_address"`
+	IPv6Addresses []string `json:"ipv6_addresses"`
+	// UseFixedIP is set if the client has a dhcp reservation (FixedIP)
+	UseFixedIP bool   `json:"use_fixedip"`
+	FixedIP    string `json:"fixed_ip"`
+}
+
+// knownClient is a client from the client history of a site.
+type knownClient struct {
+	client
+	NetworkID                 string `json:"network_id"`
+	LastIP                    string `json:"last_ip"`
+	LastSeen                  int64  `json:"last_seen"`
+	LastConnectionNetworkName string `json:"last_connection_network_name"`
+}
+
+// reservation returns the reserved ip of the client, or an empty string if there is none.
+func (c *client) reservation() string {
+	if !c.UseFixedIP {
+		return ""
+	}
+	return c.FixedIP
+}
+
+// addresses returns the ip of the client and its ipv6 addresses that are selected by policy.
+// The ip is only checked against a policy that is set explicitly, link-local addresses are always skipped.
+func (c *client) addresses(policy ipv6Policy) []string {
+	var addresses []string
+	seen := make(map[string]struct{})
+	var aaaa int
+	for i, address := range append([]string{c.IP}, append(c.IPv6Address, c.IPv6Addresses...)...) {
+		ip := net.ParseIP(address)
+		if ip == nil || ip.To4() != nil {
+			if i == 0 {
+				addresses = append(addresses, address)
+			}
+			continue
+		}
+		if _, ok := seen[ip.String()]; ok {
+			continue
+		}
+		seen[ip.String()] = struct{}{}
+		if ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if (i > 0 || policy != ipv6Policy{}) && !policy.allows(ip, c.MAC) {
+			continue
+		}
+		if policy.Max > 0 && aaaa >= policy.Max {
+			continue
+		}
+		aaaa++
+		addresses = append(addresses, ip.String())
+	}
+	return addresses
+}
+
+// allows reports whether ip of the client with mac should be published.
+// Link-local addresses are never published.
+func (p ipv6Policy) allows(ip net.IP, mac string) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	switch p.Scope {
+	case ipv6Global:
+		if isULA(ip) {
+			return false
+		}
+	case ipv6ULA:
+		if !isULA(ip) {
+			return false
+		}
+	}
+	return !p.ExcludeTemporary || !isTemporary(ip, mac)
+}
+
+// isULA reports whether ip is an unique local address (fc00::/7).
+func isULA(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// isTemporary reports whether ip has a randomized interface identifier, as used by privacy extensions.
+// Interface identifiers that are derived from mac (EUI-64) or that are assigned manually or via dhcpv6
+// (only the lower 16 bits are set) are stable.
+// The controller does not tell temporary addresses (RFC 4941) from stable but opaque ones (RFC 7217,
+// the default of NetworkManager, Windows and macOS), so the latter are reported as temporary too.
+func isTemporary(ip net.IP, mac string) bool {
+	iid := ip.To16()[8:]
+	if hw, err := net.ParseMAC(mac); err == nil && len(hw) == 6 {
+		eui64 := []byte{hw[0] ^ 0x02, hw[1], hw[2], 0xff, 0xfe, hw[3], hw[4], hw[5]}
+		if bytes.Equal(iid, eui64) {
+			return false
+		}
+	}
+	for _, b := range iid[:6] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getClients fetches the clients of site.
+// If the history is enabled clients that are offline but were seen within the retention window are included
+// with their last known ip.
+// If reservations are enabled clients with a fixed ip are always included with their reserved ip.
+func (c *controller) getClients(ctx context.Context, site string) ([]client, error) {
+	var online []client
+	if err := c.unifi.get(ctx, "/api/s/"+site+"/stat/sta", &online); err != nil {
+		return nil, fmt.Errorf("unable to list clients: %w", err)
+	}
+
+	if c.config.HistoryRetention <= 0 && !c.config.Reservations {
+		return online, nil
+	}
+
+	var known []knownClient
+	if err := c.unifi.get(ctx, "/api/s/"+site+"/rest/user", &known); err != nil {
+		return nil, fmt.Errorf("unable to list known clients: %w", err)
+	}
+
+	knownByMAC := make(map[string]*knownClient, len(known))
+	for i := range known {
+		knownByMAC[strings.ToLower(known[i].MAC)] = &known[i]
+	}
+
+	clients := make([]client, 0, len(online))
+	seen := make(map[string]struct{}, len(online))
+	for _, entry := range online {
+		mac := strings.ToLower(entry.MAC)
+		seen[mac] = struct{}{}
+		if c.config.Reservations {
+			if k, ok := knownByMAC[mac]; ok && entry.reservation() == "" {
+				entry.UseFixedIP, entry.FixedIP = k.UseFixedIP, k.FixedIP
+			}
+			if fixedIP := entry.reservation(); fixedIP != "" && fixedIP != entry.IP && !c.config.PreferObservedIP {
+				entry.IP = fixedIP
+			}
+		}
+		clients = append(clients, entry)
+	}
+
+	var networkNames map[string]string
+	since := time.Now().Add(-c.config.HistoryRetention).Unix()
+	for _, entry := range known {
+		if _, ok := seen[strings.ToLower(entry.MAC)]; ok {
+			continue
+		}
+
+		ip := ""
+		if fixedIP := entry.reservation(); c.config.Reservations && fixedIP != "" {
+			ip = fixedIP
+		} else if c.config.HistoryRetention > 0 && entry.LastSeen >= since {
+			ip = entry.LastIP
+		}
+		if ip == "" {
+			continue
+		}
+
+		network := entry.LastConnectionNetworkName
+		if network == "" && entry.NetworkID != "" {
+			if networkNames == nil {
+				var err error
+				if networkNames, err = c.getNetworkNames(ctx, site); err != nil {
+					return nil, err
+				}
+			}
+			network = networkNames[entry.NetworkID]
+		}
+
+		entry.client.Network = network
+		entry.client.IP = ip
+		clients = append(clients, entry.client)
+	}
+	return clients, nil
+}
+
+// network is a network of a unifi site.
+type network struct {
+	ID         string `json:"_id"`
+	Name       string
+	IPSubnet   string `json:"ip_subnet"`
+	DomainName string `json:"domain_name"`
+}
+
+// getNetworks returns the networks of site.
+func (c *controller) getNetworks(ctx context.Context, site string) ([]network, error) {
+	var data []network
+	if err := c.unifi.get(ctx, "/api/s/"+site+"/rest/networkconf", &data); err != nil {
+		return nil, fmt.Errorf("unable to list networks: %w", err)
+	}
+	return data, nil
+}
+
+// getNetworkNames returns the names of the networks of site by their id.
+func (c *controller) getNetworkNames(ctx context.Context, site string) (map[string]string, error) {
+	networks, err := c.getNetworks(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(networks))
+	for _, entry := range networks {
+		names[entry.ID] = entry.Name
+	}
+	return names, nil
+}
+
+// networkOf returns the name of the network whose subnet contains address, or an empty string.
+func networkOf(networks []network, address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	for _, entry := range networks {
+		_, subnet, err := net.ParseCIDR(entry.IPSubnet)
+		if err != nil {
+			continue
+		}
+		if subnet.Contains(ip) {
+			return entry.Name
+		}
+	}
+	return ""
+}
+
+// device is a unifi device (access point, switch, gateway).
+type device struct {
+	MAC     string
+	Name    string
+	IP      string
+	Adopted bool
+}
+
+// getDevices returns the adopted unifi devices of site.
+func (c *controller) getDevices(ctx context.Context, site string) ([]device, error) {
+	var data []device
+	if err := c.unifi.get(ctx, "/api/s/"+site+"/stat/device", &data); err != nil {
+		return nil, fmt.Errorf("unable to list devices: %w", err)
+	}
+	devices := data[:0]
+	for _, entry := range data {
+		if entry.Adopted {
+			devices = append(devices, entry)
+		}
+	}
+	return devices, nil
+}
@@ -1,112 +1,1331 @@
 package unifinames
 
 import (
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"encoding/hex"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/miekg/dns"
 )
 
+const (
+	// controllerAuto detects the controller type on login
+	controllerAuto = "auto"
+	// controllerLegacy is the standalone unifi controller (e.g. on a Cloud Key Gen1 or a server)
+	controllerLegacy = "legacy"
+	// controllerUnifiOS is an UniFi OS console (UDM, UDM Pro, UDR, Cloud Key Gen2+)
+	controllerUnifiOS = "unifios"
+)
+
+const (
+	// authPassword logs in with username and password
+	authPassword = "password"
+	// authAPIKey sends the api key with every request
+	authAPIKey = "apikey"
+)
+
+const (
+	// ipv6All publishes global unicast and unique local addresses
+	ipv6All = "all"
+	// ipv6Global publishes only global unicast addresses
+	ipv6Global = "global"
+	// ipv6ULA publishes only unique local addresses (fc00::/7)
+	ipv6ULA = "ula"
+)
+
+const (
+	// orderFixed answers the records of a name in the order of the controller
+	orderFixed = "fixed"
+	// orderRoundRobin rotates the records of a name with every answer
+	orderRoundRobin = "round-robin"
+	// orderShuffle answers the records of a name in random order
+	orderShuffle = "shuffle"
+)
+
+// soaConfig holds the values of the synthesized SOA records, the values that are not set are derived
+// from the zone and the refresh rate.
+type soaConfig struct {
+	// MName is the primary name server (defaults to the first name server or the host name)
+	MName string
+	// RName is the mailbox of the person responsible for the zones (defaults to hostmaster.<zone>)
+	RName string
+	// Refresh, Retry and Expire are the timers of secondaries (default to the refresh rate,
+	// a quarter of it and the refresh rate plus the time stale records are served)
+	Refresh time.Duration
+	Retry   time.Duration
+	Expire  time.Duration
+	// Minimum is the ttl of negative answers (defaults to the ttl, but at most 1 minute)
+	Minimum time.Duration
+}
+
+// transferConfig restricts the zone transfers and names the secondaries that are notified of changes.
+type transferConfig struct {
+	// To are the addresses (or networks) of the secondaries that may transfer the zones, `*` allows every address
+	To []string
+	// Notify are the secondaries (host:port) that are notified when a zone changes
+	Notify []string
+	// TSIGKey is the name of the key the transfers must be signed with, the notifies are signed with it too
+	TSIGKey string
+	// TSIGAlgorithm is the algorithm of the key (e.g. hmac-sha256.)
+	TSIGAlgorithm string
+	// TSIGSecret is the base64 encoded secret of the key
+	TSIGSecret string
+}
+
+// tsigAlgorithms maps the algorithm names of the configuration to the names used in the TSIG records.
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// ipv6Policy selects the ipv6 addresses of a client that are published.
+type ipv6Policy struct {
+	// Scope is the scope of the addresses (all, global or ula) (defaults to all)
+	Scope string
+	// ExcludeTemporary skips addresses with a randomized interface identifier (privacy extensions),
+	// this includes the stable opaque addresses of RFC 7217, only EUI-64 and manual or dhcpv6 addresses are kept
+	ExcludeTemporary bool
+	// Max is the maximum number of AAAA records per name (0 is unlimited)
+	Max int
+}
+
 type config struct {
+	// TTL is the ttl of the responses in seconds (defaults to 1hour), it is independent of the refresh rate,
+	// only stale records are served with StaleTTL
+	TTL uint32
+	// Refresh is the refresh rate of the clients (defaults to TTL)
+	Refresh time.Duration
+	// MinTTL is the minimum ttl of the responses
+	MinTTL time.Duration
+	// MaxStale is how long the records are served after a refresh is due but failed (defaults to 1hour),
+	// after that the names stop resolving (0 disables serving stale records)
+	MaxStale time.Duration
+	// StaleTTL is the ttl of stale records (defaults to 30 seconds)
+	StaleTTL time.Duration
+	// CacheFile is the file the records are written to after each successful refresh, they are loaded
+	// from it on startup so the names resolve before the controllers are reachable (empty disables it)
+	CacheFile string
+	// CacheMaxAge is the maximum age of the records that are loaded from the cache file (defaults to 1 day)
+	CacheMaxAge time.Duration
+	// ReverseZones are the reverse zones (in-addr.arpa. and ip6.arpa.) PTR queries are answered in,
+	// if empty they are answered for every known address
+	ReverseZones []string
+	// Fall are the zones whose queries are passed to the next plugin if there is no record,
+	// in the other zones the answers are authoritative (NXDOMAIN or NODATA)
+	Fall fall.F
+	// SOA holds the values of the SOA records of the zones
+	SOA soaConfig
+	// NS are the name servers of the zones (defaults to the mname of the SOA, without both there are no NS records)
+	NS []string
+	// Transfer enables zone transfers (AXFR and IXFR) of the zones, if set
+	Transfer *transferConfig
+	// Order is the order of the records of a name (fixed, round-robin or shuffle) (defaults to fixed)
+	Order string
+	// Debug mode
+	Debug bool
+	// Controllers are the unifi controllers to get the clients from
+	Controllers []*controllerConfig
+}
+
+type controllerConfig struct {
 	// Networks maps the network to the specified domain
 	// e.g.
 	// "LAN" => local
 	// so if a client has the name "Joe's Notebook" and it is in the "LAN" network it will get
 	// "joe-s-notebook.local" as a hostname
 	Networks map[string]string
-	// TTL to use for response (this is also the refresh rate of the client mapping) (defaults to 1hour)
-	TTL uint32
-	// Debug mode
-	Debug bool
-	// UnifiControllerURL in the form of http://localhost:8443
-	UnifiControllerURL string
-	// UnifiSite which site to use (most of the cases its default)
-	UnifiSite string
-	// UnifiUsername
-	UnifiUsername string
-	// UnifiPassword
-	UnifiPassword string
-	// UnifiSSLFingerprint is the ssl certificate fingerprint we expect
-	UnifiSSLFingerprint []byte
+	// Sites maps additional sites to their own network to domain mapping
+	// e.g.
+	// "office" => "LAN" => office.local
+	Sites map[string]map[string]string
+	// IPv6Policies holds the ipv6 address selection of the Networks by network
+	IPv6Policies map[string]ipv6Policy
+	// SiteIPv6Policies holds the ipv6 address selection of the Sites by site and network
+	SiteIPv6Policies map[string]map[string]ipv6Policy
+	// AllSites discovers all sites of the controller and serves each of them with the Networks mapping,
+	// the site name is inserted into the domain, e.g. "joe-s-notebook.office.local"
+	AllSites bool
+	// AutoNetworks maps every network that has a domain name set in the controller to that domain,
+	// the Networks mapping takes precedence
+	AutoNetworks bool
+	// URL in the form of http://localhost:8443
+	URL string
+	// FailoverURLs are standby endpoints of the same controller, they are tried in order when URL fails
+	FailoverURLs []string
+	// Site which site to use (most of the cases its default)
+	Site string
+	// Username
+	Username string
+	// Password
+	Password string
+	// UsernameFile and PasswordFile are read again on login when they change, they take precedence
+	UsernameFile *secretFile
+	PasswordFile *secretFile
+	// TOTPSecret is the secret of the two-factor authentication of the account, if set a one-time code is sent on login
+	TOTPSecret []byte
+	// SSLFingerprint is the ssl certificate fingerprint we expect
+	SSLFingerprint []byte
+	// RootCAs are used to verify the certificate of the controller instead of the system pool, if set
+	RootCAs *x509.CertPool
+	// Timeout of the requests to the controller (defaults to 1 minute)
+	Timeout time.Duration
+	// RetryAttempts is the number of attempts of a request that fails transiently (defaults to 3, 1 disables retries),
+	// the attempts are spread by a jittered exponential backoff between RetryMinBackoff and RetryMaxBackoff
+	// (defaults to 1 second and 30 seconds)
+	RetryAttempts   int
+	RetryMinBackoff time.Duration
+	RetryMaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive rejected logins after which no login is attempted
+	// for BreakerCooldown, so the account does not get locked (defaults to 3 and 15 minutes, negative disables it)
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Refresh is the refresh rate of the clients of this controller (defaults to the global refresh rate)
+	Refresh time.Duration
+	// AuthMode is the authentication (password or apikey),
+	// if empty the api key is used if one is set
+	AuthMode string
+	// APIKey is used instead of username and password if set
+	APIKey string
+	// APIKeyFile is read again when it changes, it takes precedence
+	APIKeyFile *secretFile
+	// HistoryRetention enables the resolving of offline clients by their last known ip,
+	// clients that were seen within this duration are resolved (0 disables it)
+	HistoryRetention time.Duration
+	// Reservations resolves clients with a dhcp reservation (fixed ip) to the reserved ip,
+	// even if they are not connected
+	Reservations bool
+	// PreferObservedIP uses the currently observed ip instead of the reserved ip if they differ
+	PreferObservedIP bool
+	// Devices publishes the adopted unifi devices (access points, switches, gateways)
+	Devices bool
+	// DevicesDomain is the domain of the devices, if empty they are published in the domain of their network
+	DevicesDomain string
+	// Events applies the events of the controller as they happen, polling stays as periodic reconciliation
+	Events bool
+	// Type is the controller type (auto, legacy or unifios) (defaults to auto)
+	Type string
+
+	// position is the file and line of the Unifi directive, it is used in errors
+	position string
+	// inherited is set if the networks and sites are the ones outside of an Unifi block,
+	// their zones are shared by every controller that inherits them
+	inherited bool
 }
 
 func newConfigFromDispenser(c caddyfile.Dispenser) (*config, error) {
 	config := config{
-		TTL:      60 * 60,
-		Networks: map[string]string{},
+		TTL:         60 * 60,
+		MaxStale:    time.Hour,
+		StaleTTL:    30 * time.Second,
+		CacheMaxAge: 24 * time.Hour,
+		Order:       orderFixed,
 	}
+	// defaults holds the controller settings outside of an Unifi block, they apply to every controller
+	defaults := newControllerConfig()
+	// failover is the position of a Failover line outside of an Unifi block
+	var failover string
+	// ttlPosition is the position of the TTL line
+	var ttlPosition string
+	// transferPosition is the position of the Transfer block
+	var transferPosition string
+	// networksPosition is the position of the first Network line or Site block outside of an Unifi block
+	var networksPosition string
+	// seen holds the positions of the properties that may only be set once
+	seen := properties{}
 
 	for c.NextBlock() {
-		if strings.EqualFold(c.Val(), "network") {
-			if c.NextArg() {
-				network := strings.ToLower(c.Val())
-				if c.NextArg() {
-					domain := strings.ToLower(strings.Trim(c.Val(), "."))
-					if !govalidator.IsDNSName(domain) {
-						return nil, fmt.Errorf("'%s' is not a valid domain name", domain)
-					}
-					domain = domain + "."
-					config.Networks[network] = domain
+		position := fmt.Sprintf("%s:%d", c.File(), c.Line())
+		if strings.EqualFold(c.Val(), "failover") && failover == "" {
+			failover = position
+		}
+		if ok, err := parseControllerProperty(&c, defaults, seen); err != nil {
+			return nil, err
+		} else if ok {
+			if networksPosition == "" && len(defaults.Networks)+len(defaults.Sites) > 0 {
+				networksPosition = position
+			}
+			continue
+		}
+		switch strings.ToLower(c.Val()) {
+		case "ttl", "refresh", "minttl", "servestale", "cachefile", "fallthrough", "soa", "transfer", "order":
+			if err := seen.once(&c, c.Val()); err != nil {
+				return nil, err
+			}
+		}
+		if strings.EqualFold(c.Val(), "ttl") {
+			args, err := lineArgs(&c, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			ttl, err := parseTTL(args[0])
+			if err != nil {
+				return nil, c.Errf("Invalid TTL value: '%s'", args[0])
+			}
+			config.TTL = uint32(ttl / time.Second)
+			ttlPosition = position
+		} else if strings.EqualFold(c.Val(), "refresh") {
+			args, err := lineArgs(&c, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			if config.Refresh, err = time.ParseDuration(args[0]); err != nil || config.Refresh <= 0 {
+				return nil, c.Errf("Invalid Refresh value: '%s'", args[0])
+			}
+		} else if strings.EqualFold(c.Val(), "minttl") {
+			args, err := lineArgs(&c, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			if config.MinTTL, err = parseTTL(args[0]); err != nil {
+				return nil, c.Errf("Invalid MinTTL value: '%s'", args[0])
+			}
+		} else if strings.EqualFold(c.Val(), "servestale") {
+			args, err := lineArgs(&c, 1, 2)
+			if err != nil {
+				return nil, err
+			}
+			if config.MaxStale, err = time.ParseDuration(args[0]); err != nil || config.MaxStale < 0 {
+				return nil, c.Errf("Invalid ServeStale value: '%s'", args[0])
+			}
+			if len(args) > 1 {
+				if config.StaleTTL, err = parseTTL(args[1]); err != nil {
+					return nil, c.Errf("Invalid ServeStale ttl value: '%s'", args[1])
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "cachefile") {
+			args, err := lineArgs(&c, 1, 2)
+			if err != nil {
+				return nil, err
+			}
+			config.CacheFile = args[0]
+			if len(args) > 1 {
+				if config.CacheMaxAge, err = time.ParseDuration(args[1]); err != nil || config.CacheMaxAge <= 0 {
+					return nil, c.Errf("Invalid CacheFile max age: '%s'", args[1])
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "reversezones") {
+			args, err := lineArgs(&c, 1, -1)
+			if err != nil {
+				return nil, err
+			}
+			for _, arg := range args {
+				zone, err := parseReverseZone(arg)
+				if err != nil {
+					return nil, c.Err(err.Error())
 				}
+				config.ReverseZones = append(config.ReverseZones, zone)
+			}
+		} else if strings.EqualFold(c.Val(), "fallthrough") {
+			args, err := lineArgs(&c, 0, -1)
+			if err != nil {
+				return nil, err
+			}
+			config.Fall.SetZonesFromArgs(args)
+		} else if strings.EqualFold(c.Val(), "soa") {
+			if err := parseSOA(&c, &config.SOA); err != nil {
+				return nil, err
 			}
-		} else if strings.EqualFold(c.Val(), "ttl") {
-			if c.NextArg() {
-				ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+		} else if strings.EqualFold(c.Val(), "ns") {
+			args, err := lineArgs(&c, 1, -1)
+			if err != nil {
+				return nil, err
+			}
+			for _, arg := range args {
+				ns, err := parseDomain(arg)
 				if err != nil {
-					return nil, fmt.Errorf("Invalid TTL value: '%s'", c.Val())
+					return nil, c.Err(err.Error())
 				}
-				config.TTL = uint32(ttl)
+				config.NS = append(config.NS, ns)
+			}
+		} else if strings.EqualFold(c.Val(), "transfer") {
+			transferPosition = position
+			transfer, err := parseTransfer(&c)
+			if err != nil {
+				return nil, err
+			}
+			config.Transfer = transfer
+		} else if strings.EqualFold(c.Val(), "order") {
+			args, err := lineArgs(&c, 1, 1)
+			if err != nil {
+				return nil, err
+			}
+			switch order := strings.ToLower(args[0]); order {
+			case orderFixed, orderRoundRobin, orderShuffle:
+				config.Order = order
+			default:
+				return nil, c.Errf("Invalid Order value: '%s'", args[0])
 			}
 		} else if strings.EqualFold(c.Val(), "debug") {
+			if _, err := lineArgs(&c, 0, 0); err != nil {
+				return nil, err
+			}
 			config.Debug = true
 		} else if strings.EqualFold(c.Val(), "unifi") {
-			if c.NextArg() {
-				config.UnifiControllerURL = strings.TrimRight(c.Val(), "/")
-				if c.NextArg() {
-					config.UnifiSite = c.Val()
-					if c.NextArg() {
-						config.UnifiUsername = c.Val()
-						if c.NextArg() {
-							config.UnifiPassword = c.Val()
-							if c.NextArg() {
-								var err error
-								config.UnifiSSLFingerprint, err = hex.DecodeString(strings.ReplaceAll(c.Val(), ":", ""))
-								if err != nil {
-									return nil, fmt.Errorf("unable to parse UnifiSSLFingerprint")
-								}
-							}
-						}
-					}
-				}
+			controller, err := parseController(&c)
+			if err != nil {
+				return nil, err
 			}
+			config.Controllers = append(config.Controllers, controller)
+		} else {
+			return nil, c.Errf("Unknown property '%s'", c.Val())
+		}
+	}
+
+	// the secondaries need the name servers of the zones
+	if config.Transfer != nil && len(config.NS) == 0 && config.SOA.MName == "" {
+		return nil, fmt.Errorf("%s - Error during parsing: Transfer needs NS or the mname of the SOA", transferPosition)
+	}
+
+	// the refresh rate defaults to the ttl, it must not be zero
+	if config.TTL == 0 && config.Refresh == 0 {
+		for _, controller := range config.Controllers {
+			if controller.Refresh == 0 {
+				return nil, fmt.Errorf("%s - Error during parsing: TTL 0 needs a Refresh rate, the refresh rate defaults to the TTL", ttlPosition)
+			}
+		}
+	}
+
+	// a standby belongs to one controller, so it is only inherited if there is a single controller
+	if failover != "" && len(config.Controllers) > 1 {
+		return nil, fmt.Errorf("%s - Error during parsing: Failover outside of an Unifi block needs a single controller, set it in the block of its controller", failover)
+	}
+
+	var inherited bool
+	for _, controller := range config.Controllers {
+		if len(controller.Networks) == 0 && len(controller.Sites) == 0 {
+			inherited = true
+			controller.Networks = defaults.Networks
+			controller.Sites = defaults.Sites
+			controller.IPv6Policies = defaults.IPv6Policies
+			controller.SiteIPv6Policies = defaults.SiteIPv6Policies
+			controller.inherited = true
+		}
+		controller.AllSites = controller.AllSites || defaults.AllSites
+		controller.AutoNetworks = controller.AutoNetworks || defaults.AutoNetworks
+		controller.Events = controller.Events || defaults.Events
+		if controller.APIKey == "" {
+			controller.APIKey, controller.APIKeyFile = defaults.APIKey, defaults.APIKeyFile
+		}
+		if controller.Username == "" {
+			controller.Username, controller.UsernameFile = defaults.Username, defaults.UsernameFile
+		}
+		if controller.Password == "" {
+			controller.Password, controller.PasswordFile = defaults.Password, defaults.PasswordFile
+		}
+		if len(controller.TOTPSecret) == 0 {
+			controller.TOTPSecret = defaults.TOTPSecret
+		}
+		if controller.HistoryRetention == 0 {
+			controller.HistoryRetention = defaults.HistoryRetention
+		}
+		if len(controller.FailoverURLs) == 0 {
+			controller.FailoverURLs = defaults.FailoverURLs
+		}
+		if !controller.Devices {
+			controller.Devices = defaults.Devices
+			controller.DevicesDomain = defaults.DevicesDomain
+		}
+		if !controller.Reservations {
+			controller.Reservations = defaults.Reservations
+			controller.PreferObservedIP = defaults.PreferObservedIP
+		}
+		if controller.Site == "" {
+			controller.Site = defaults.Site
+		}
+		if controller.Type == "" {
+			controller.Type = defaults.Type
+		}
+		if controller.Type == "" {
+			controller.Type = controllerAuto
+		}
+		if controller.Timeout == 0 {
+			controller.Timeout = defaults.Timeout
+		}
+		if controller.RetryAttempts == 0 {
+			controller.RetryAttempts = defaults.RetryAttempts
+			controller.RetryMinBackoff, controller.RetryMaxBackoff = defaults.RetryMinBackoff, defaults.RetryMaxBackoff
+		}
+		if controller.RetryAttempts == 0 {
+			controller.RetryAttempts, controller.RetryMinBackoff, controller.RetryMaxBackoff = 3, time.Second, 30*time.Second
+		}
+		if controller.BreakerThreshold == 0 {
+			controller.BreakerThreshold, controller.BreakerCooldown = defaults.BreakerThreshold, defaults.BreakerCooldown
+		}
+		if controller.BreakerThreshold == 0 {
+			controller.BreakerThreshold, controller.BreakerCooldown = 3, 15*time.Minute
 		}
 	}
+	// the networks outside of an Unifi block are only used by the controllers without networks of their own
+	if networksPosition != "" && len(config.Controllers) > 0 && !inherited {
+		return nil, fmt.Errorf("%s - Error during parsing: Networks outside of an Unifi block are not used, every controller sets its own networks", networksPosition)
+	}
+
 	if config.Debug {
 		log.Println("[unifi-names] Debug Mode is on")
-		log.Printf("[unifi-names] Parsed %d Networks\n", len(config.Networks))
-		log.Printf("[unifi-names] TTL is %d", config.TTL)
-		log.Printf("[unifi-names] Controller URL is `%s'", config.UnifiControllerURL)
-		log.Printf("[unifi-names] Controller SSL fingerprint is `%x'", config.UnifiSSLFingerprint)
+		log.Printf("[unifi-names] TTL is %d (min %s), refresh is %s", config.TTL, config.MinTTL, config.Refresh)
+		log.Printf("[unifi-names] Serving stale records for %s with ttl %s", config.MaxStale, config.StaleTTL)
+		log.Printf("[unifi-names] Reverse zones are %v", config.ReverseZones)
+		log.Printf("[unifi-names] Fallthrough zones are %v", config.Fall.Zones)
+		log.Printf("[unifi-names] SOA is %+v, name servers are %v", config.SOA, config.NS)
+		if config.Transfer != nil {
+			log.Printf("[unifi-names] Transfers to %v, notifying %v, tsig key `%s'", config.Transfer.To, config.Transfer.Notify, config.Transfer.TSIGKey)
+		}
+		log.Printf("[unifi-names] Records are ordered %s", config.Order)
+		log.Printf("[unifi-names] Cache file is `%s' (max age %s)", config.CacheFile, config.CacheMaxAge)
+		for _, controller := range config.Controllers {
+			log.Printf("[unifi-names] Controller URL is `%s'", controller.URL)
+			log.Printf("[unifi-names] Controller failover URLs are %v", controller.FailoverURLs)
+			log.Printf("[unifi-names] Parsed %d Networks\n", len(controller.Networks))
+			log.Printf("[unifi-names] Parsed %d Sites\n", len(controller.Sites))
+			log.Printf("[unifi-names] Discover all sites: %t\n", controller.AllSites)
+			log.Printf("[unifi-names] Discover networks: %t\n", controller.AutoNetworks)
+			log.Printf("[unifi-names] Controller SSL fingerprint is `%x'", controller.SSLFingerprint)
+			log.Printf("[unifi-names] Controller type is `%s'", controller.Type)
+			log.Printf("[unifi-names] Controller uses api key: %t", controller.useAPIKey())
+			log.Printf("[unifi-names] Controller uses custom root cas: %t", controller.RootCAs != nil)
+			log.Printf("[unifi-names] Controller timeout is %s, refresh is %s", controller.Timeout, controller.Refresh)
+			log.Printf("[unifi-names] Controller retries %d times (backoff %s to %s)", controller.RetryAttempts-1, controller.RetryMinBackoff, controller.RetryMaxBackoff)
+			log.Printf("[unifi-names] Controller circuit breaker opens after %d rejected logins for %s", controller.BreakerThreshold, controller.BreakerCooldown)
+			log.Printf("[unifi-names] Controller uses two-factor authentication: %t", len(controller.TOTPSecret) > 0)
+			log.Printf("[unifi-names] Controller history retention is %s", controller.HistoryRetention)
+			log.Printf("[unifi-names] Controller resolves devices: %t (domain `%s')", controller.Devices, controller.DevicesDomain)
+			log.Printf("[unifi-names] Controller events: %t", controller.Events)
+			log.Printf("[unifi-names] Controller resolves reservations: %t (prefer observed ip: %t)", controller.Reservations, controller.PreferObservedIP)
+		}
+	}
+	if len(config.Controllers) == 0 {
+		return nil, c.Err("No controller set")
 	}
-	if len(config.Networks) <= 0 {
-		return nil, fmt.Errorf("There are no networks to handle")
+	for _, controller := range config.Controllers {
+		if err := controller.validate(); err != nil {
+			return nil, fmt.Errorf("%s - Error during parsing: %v", controller.position, err)
+		}
 	}
-	if config.UnifiControllerURL == "" {
-		return nil, fmt.Errorf("No controller url set")
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
-	if config.UnifiSite == "" {
-		return nil, fmt.Errorf("No controller site set")
+	return &config, nil
+}
+
+// newControllerConfig returns an empty controller config.
+func newControllerConfig() *controllerConfig {
+	return &controllerConfig{
+		Networks:         map[string]string{},
+		Sites:            map[string]map[string]string{},
+		IPv6Policies:     map[string]ipv6Policy{},
+		SiteIPv6Policies: map[string]map[string]ipv6Policy{},
 	}
-	if config.UnifiUsername == "" {
-		return nil, fmt.Errorf("No controller username set")
+}
+
+// parseController parses an Unifi line (`Unifi <url> <site> <username> <password> <fingerprint>`) and its block.
+func parseController(c *caddyfile.Dispenser) (*controllerConfig, error) {
+	controller := newControllerConfig()
+	controller.position = fmt.Sprintf("%s:%d", c.File(), c.Line())
+
+	args, block, err := blockArgs(c, 0, 5)
+	if err != nil {
+		return nil, err
 	}
-	if config.UnifiPassword == "" {
-		return nil, fmt.Errorf("No controller password set")
+	for i := range args {
+		if args[i], err = expandEnv(args[i]); err != nil {
+			return nil, c.Err(err.Error())
+		}
 	}
-	return &config, nil
+	if len(args) > 0 {
+		if controller.URL, err = parseURL(c, args[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) > 1 {
+		controller.Site = args[1]
+	}
+	if len(args) > 2 {
+		controller.Username = args[2]
+	}
+	if len(args) > 3 {
+		controller.Password = args[3]
+	}
+	if len(args) > 4 {
+		if controller.SSLFingerprint, err = parseFingerprint(c, args[4]); err != nil {
+			return nil, err
+		}
+	}
+	if !block {
+		return controller, nil
+	}
+
+	seen := properties{}
+	err = parseBlock(c, func() error {
+		if ok, err := parseConnectionProperty(c, controller, seen); err != nil || ok {
+			return err
+		}
+		if ok, err := parseControllerProperty(c, controller, seen); err != nil || ok {
+			return err
+		}
+		return c.Errf("Unknown property '%s'", c.Val())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return controller, nil
+}
+
+// validate checks that the controller has everything it needs.
+func (c *controllerConfig) validate() error {
+	if len(c.domains()) <= 0 && !c.AutoNetworks {
+		return fmt.Errorf("There are no networks to handle")
+	}
+	if c.URL == "" {
+		return fmt.Errorf("No controller url set")
+	}
+	if c.Site == "" {
+		return fmt.Errorf("No controller site set")
+	}
+	if c.AuthMode == authAPIKey && c.APIKey == "" {
+		return fmt.Errorf("No controller api key set")
+	}
+	if c.useAPIKey() {
+		return nil
+	}
+	if c.Username == "" {
+		return fmt.Errorf("No controller username set")
+	}
+	if c.Password == "" {
+		return fmt.Errorf("No controller password set")
+	}
+	return nil
+}
+
+// validate checks that no controller is set up twice and that every zone is served by one site only.
+func (c *config) validate() error {
+	controllers := make(map[string]*controllerConfig, len(c.Controllers))
+	// zones maps every zone to the position of the controller and the site that serves it,
+	// the zones of the inherited networks are served by all controllers together
+	zones := make(map[string]string)
+	addZones := func(controller *controllerConfig, site string, networks map[string]string) error {
+		scope := controller.position + "/" + site
+		if controller.inherited {
+			scope = "*/" + site
+		}
+		for _, domain := range networks {
+			if other, ok := zones[domain]; ok && other != scope {
+				return fmt.Errorf("%s - Error during parsing: Zone '%s' is already served by another site or controller", controller.position, domain)
+			}
+			zones[domain] = scope
+		}
+		return nil
+	}
+
+	for _, controller := range c.Controllers {
+		key := controller.URL + "/" + controller.Site
+		if other, ok := controllers[key]; ok {
+			return fmt.Errorf("%s - Error during parsing: Controller '%s' with site '%s' is already set up at %s", controller.position, controller.URL, controller.Site, other.position)
+		}
+		controllers[key] = controller
+
+		// with AllSites the site label is inserted into the domains of the networks
+		if !controller.AllSites {
+			if err := addZones(controller, controller.Site, controller.Networks); err != nil {
+				return err
+			}
+		}
+		for site, networks := range controller.Sites {
+			if err := addZones(controller, site, networks); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// useAPIKey reports whether the api key is used instead of username and password.
+func (c *controllerConfig) useAPIKey() bool {
+	if c.AuthMode != "" {
+		return c.AuthMode == authAPIKey
+	}
+	return c.APIKey != ""
+}
+
+// parseConnectionProperty parses the directive of the current line if it is a property of the Unifi block
+// that describes the connection to the controller, it reports whether the directive was handled.
+// Every property may only be set once in the block, seen holds the properties that were set.
+func parseConnectionProperty(c *caddyfile.Dispenser, controller *controllerConfig, seen properties) (bool, error) {
+	directive := strings.ToLower(c.Val())
+	switch directive {
+	case "url", "username", "password", "fingerprint", "ca", "auth", "refresh":
+	default:
+		return false, nil
+	}
+	if err := seen.once(c, c.Val()); err != nil {
+		return true, err
+	}
+	args, err := lineArgs(c, 1, 1)
+	if err != nil {
+		return true, err
+	}
+	value, err := expandEnv(args[0])
+	if err != nil {
+		return true, c.Err(err.Error())
+	}
+
+	switch directive {
+	case "url":
+		if controller.URL, err = parseURL(c, value); err != nil {
+			return true, err
+		}
+	case "username":
+		controller.Username = value
+	case "password":
+		controller.Password = value
+	case "fingerprint":
+		if controller.SSLFingerprint, err = parseFingerprint(c, value); err != nil {
+			return true, err
+		}
+	case "ca":
+		buf, err := ioutil.ReadFile(value)
+		if err != nil {
+			return true, c.Errf("unable to read ca file: %v", err)
+		}
+		controller.RootCAs = x509.NewCertPool()
+		if !controller.RootCAs.AppendCertsFromPEM(buf) {
+			return true, c.Errf("no certificates found in ca file `%s'", value)
+		}
+	case "refresh":
+		if controller.Refresh, err = time.ParseDuration(value); err != nil || controller.Refresh <= 0 {
+			return true, c.Errf("Invalid refresh value: '%s'", value)
+		}
+	case "auth":
+		switch mode := strings.ToLower(value); mode {
+		case authPassword, authAPIKey:
+			controller.AuthMode = mode
+		default:
+			return true, c.Errf("Invalid auth value: '%s'", value)
+		}
+	}
+	return true, nil
+}
+
+// parseTTL parses a ttl in seconds (`60`) or in the duration syntax (`1m`).
+func parseTTL(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 || ttl/time.Second > math.MaxUint32 {
+		return 0, fmt.Errorf("ttl out of range")
+	}
+	return ttl, nil
+}
+
+// parseFingerprint parses a sha1 certificate fingerprint, the bytes can be separated by colons.
+func parseFingerprint(c *caddyfile.Dispenser, s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(fingerprint) == 0 {
+		return nil, c.Errf("unable to parse UnifiSSLFingerprint: '%s'", s)
+	}
+	return fingerprint, nil
+}
+
+// parseURL validates the url of a controller endpoint, the trailing slash is removed.
+func parseURL(c *caddyfile.Dispenser, s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", c.Errf("Invalid controller url: '%s'", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", c.Errf("Invalid controller url: '%s', it must not have a query or fragment", s)
+	}
+	return strings.TrimRight(s, "/"), nil
+}
+
+// parseControllerProperty parses the directive of the current line if it is a controller setting,
+// it reports whether the directive was handled.
+// The properties with a single value may only be set once in the block, seen holds the properties that were set.
+func parseControllerProperty(c *caddyfile.Dispenser, controller *controllerConfig, seen properties) (bool, error) {
+	switch strings.ToLower(strings.ReplaceAll(c.Val(), "_", "")) {
+	case "unifitype", "history", "reservations", "devices", "timeout", "retry", "circuitbreaker",
+		"apikey", "apikeyfile", "totpsecretfile", "usernamefile", "passwordfile":
+		if err := seen.once(c, c.Val()); err != nil {
+			return true, err
+		}
+	}
+	if strings.EqualFold(c.Val(), "network") {
+		if err := parseNetwork(c, controller.Networks, controller.IPv6Policies); err != nil {
+			return true, err
+		}
+	} else if strings.EqualFold(c.Val(), "site") {
+		// `Site <name> { ... }` serves an additional site, `Site <name>` is the site of the controller
+		directive := c.Val()
+		args, block, err := blockArgs(c, 1, 1)
+		if err != nil {
+			return true, err
+		}
+		site, err := expandEnv(args[0])
+		if err != nil {
+			return true, c.Err(err.Error())
+		}
+		if !block {
+			if err := seen.once(c, directive); err != nil {
+				return true, err
+			}
+			controller.Site = site
+			return true, nil
+		}
+		if _, ok := controller.Sites[site]; ok {
+			return true, c.Errf("Duplicate site '%s'", site)
+		}
+		networks := map[string]string{}
+		policies := map[string]ipv6Policy{}
+		err = parseBlock(c, func() error {
+			if !strings.EqualFold(c.Val(), "network") {
+				return c.Errf("Unknown property '%s'", c.Val())
+			}
+			return parseNetwork(c, networks, policies)
+		})
+		if err != nil {
+			return true, err
+		}
+		controller.Sites[site] = networks
+		controller.SiteIPv6Policies[site] = policies
+	} else if strings.EqualFold(c.Val(), "allsites") {
+		if _, err := lineArgs(c, 0, 0); err != nil {
+			return true, err
+		}
+		controller.AllSites = true
+	} else if strings.EqualFold(c.Val(), "autonetworks") {
+		if _, err := lineArgs(c, 0, 0); err != nil {
+			return true, err
+		}
+		controller.AutoNetworks = true
+	} else if strings.EqualFold(c.Val(), "events") {
+		if _, err := lineArgs(c, 0, 0); err != nil {
+			return true, err
+		}
+		controller.Events = true
+	} else if strings.EqualFold(c.Val(), "unifitype") {
+		args, err := lineArgs(c, 1, 1)
+		if err != nil {
+			return true, err
+		}
+		switch t := strings.ToLower(args[0]); t {
+		case controllerAuto, controllerLegacy, controllerUnifiOS:
+			controller.Type = t
+		default:
+			return true, c.Errf("Invalid UnifiType value: '%s'", args[0])
+		}
+	} else if strings.EqualFold(c.Val(), "history") {
+		args, err := lineArgs(c, 1, 1)
+		if err != nil {
+			return true, err
+		}
+		retention, err := time.ParseDuration(args[0])
+		if err != nil || retention < 0 {
+			return true, c.Errf("Invalid History value: '%s'", args[0])
+		}
+		controller.HistoryRetention = retention
+	} else if strings.EqualFold(c.Val(), "reservations") {
+		args, err := lineArgs(c, 0, 1)
+		if err != nil {
+			return true, err
+		}
+		controller.Reservations = true
+		if len(args) > 0 {
+			switch strings.ToLower(args[0]) {
+			case "reserved":
+				controller.PreferObservedIP = false
+			case "observed":
+				controller.PreferObservedIP = true
+			default:
+				return true, c.Errf("Invalid Reservations value: '%s'", args[0])
+			}
+		}
+	} else if strings.EqualFold(c.Val(), "devices") {
+		args, err := lineArgs(c, 0, 1)
+		if err != nil {
+			return true, err
+		}
+		controller.Devices = true
+		if len(args) > 0 {
+			if controller.DevicesDomain, err = parseDomain(args[0]); err != nil {
+				return true, c.Err(err.Error())
+			}
+		}
+	} else if strings.EqualFold(c.Val(), "timeout") {
+		args, err := lineArgs(c, 1, 1)
+		if err != nil {
+			return true, err
+		}
+		if controller.Timeout, err = time.ParseDuration(args[0]); err != nil || controller.Timeout <= 0 {
+			return true, c.Errf("Invalid Timeout value: '%s'", args[0])
+		}
+	} else if strings.EqualFold(c.Val(), "retry") {
+		// `Retry <attempts> [min-backoff [max-backoff]]`
+		args, err := lineArgs(c, 1, 3)
+		if err != nil {
+			return true, err
+		}
+		attempts, err := strconv.Atoi(args[0])
+		if err != nil || attempts < 1 {
+			return true, c.Errf("Invalid Retry attempts: '%s'", args[0])
+		}
+		minBackoff, maxBackoff := time.Second, 30*time.Second
+		if len(args) > 1 {
+			if minBackoff, err = time.ParseDuration(args[1]); err != nil || minBackoff <= 0 {
+				return true, c.Errf("Invalid Retry backoff: '%s'", args[1])
+			}
+			if maxBackoff < minBackoff {
+				maxBackoff = minBackoff
+			}
+		}
+		if len(args) > 2 {
+			if maxBackoff, err = time.ParseDuration(args[2]); err != nil || maxBackoff < minBackoff {
+				return true, c.Errf("Invalid Retry maximum backoff: '%s'", args[2])
+			}
+		}
+		controller.RetryAttempts, controller.RetryMinBackoff, controller.RetryMaxBackoff = attempts, minBackoff, maxBackoff
+	} else if strings.EqualFold(c.Val(), "circuitbreaker") {
+		// `CircuitBreaker <rejected-logins> [cooldown]` or `CircuitBreaker off`
+		args, err := lineArgs(c, 1, 2)
+		if err != nil {
+			return true, err
+		}
+		if strings.EqualFold(args[0], "off") && len(args) == 1 {
+			controller.BreakerThreshold, controller.BreakerCooldown = -1, 0
+			return true, nil
+		}
+		threshold, err := strconv.Atoi(args[0])
+		if err != nil || threshold < 1 {
+			return true, c.Errf("Invalid CircuitBreaker threshold: '%s'", args[0])
+		}
+		cooldown := 15 * time.Minute
+		if len(args) > 1 {
+			if cooldown, err = time.ParseDuration(args[1]); err != nil || cooldown <= 0 {
+				return true, c.Errf("Invalid CircuitBreaker cooldown: '%s'", args[1])
+			}
+		}
+		controller.BreakerThreshold, controller.BreakerCooldown = threshold, cooldown
+	} else if strings.EqualFold(c.Val(), "failover") {
+		args, err := lineArgs(c, 1, -1)
+		if err != nil {
+			return true, err
+		}
+		for _, arg := range args {
+			url, err := parseURL(c, arg)
+			if err != nil {
+				return true, err
+			}
+			controller.FailoverURLs = append(controller.FailoverURLs, url)
+		}
+	} else if strings.EqualFold(c.Val(), "apikey") {
+		args, err := lineArgs(c, 1, 1)
+		if err != nil {
+			return true, err
+		}
+		if controller.APIKey, err = expandEnv(args[0]); err != nil {
+			return true, c.Err(err.Error())
+		}
+	} else if strings.EqualFold(c.Val(), "totpsecretfile") {
+		args, err := lineArgs(c, 1, 1)
+		if err != nil {
+			return true, err
+		}
+		buf, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return true, c.Errf("unable to read totp secret file: %v", err)
+		}
+		if controller.TOTPSecret, err = parseTOTPSecret(string(buf)); err != nil {
+			return true, c.Err(err.Error())
+		}
+	} else if strings.EqualFold(c.Val(), "apikeyfile") {
+		f, err := parseSecretFile(c)
+		if err != nil {
+			return true, err
+		}
+		controller.APIKey, controller.APIKeyFile = f.value, f
+	} else if isDirective(c, "username_file") {
+		f, err := parseSecretFile(c)
+		if err != nil {
+			return true, err
+		}
+		controller.Username, controller.UsernameFile = f.value, f
+	} else if isDirective(c, "password_file") {
+		f, err := parseSecretFile(c)
+		if err != nil {
+			return true, err
+		}
+		controller.Password, controller.PasswordFile = f.value, f
+	} else {
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseSecretFile parses the argument of a line that names a secret file (`password_file /run/secrets/pw`).
+func parseSecretFile(c *caddyfile.Dispenser) (*secretFile, error) {
+	args, err := lineArgs(c, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newSecretFile(args[0])
+	if err != nil {
+		return nil, c.Errf("unable to read %s: %v", c.Val(), err)
+	}
+	return f, nil
+}
+
+// properties holds the positions of the properties of a block that may only be set once, by their name
+// in lower case without underscores.
+type properties map[string]string
+
+// once records the property directive of the current line, it fails if the property was already set.
+func (p properties) once(c *caddyfile.Dispenser, directive string) error {
+	name := strings.ToLower(strings.ReplaceAll(directive, "_", ""))
+	if other, ok := p[name]; ok {
+		return c.Errf("Duplicate property '%s', it is already set at %s", directive, other)
+	}
+	p[name] = fmt.Sprintf("%s:%d", c.File(), c.Line())
+	return nil
+}
+
+// isDirective reports whether the current token is the directive name,
+// the case and underscores are ignored (`password_file` matches `PasswordFile`).
+func isDirective(c *caddyfile.Dispenser, name string) bool {
+	return strings.EqualFold(strings.ReplaceAll(c.Val(), "_", ""), strings.ReplaceAll(name, "_", ""))
+}
+
+// blockArgs returns the arguments of the current line and whether the line opens a nested block,
+// the number of arguments must be within min and max (-1 is unlimited).
+func blockArgs(c *caddyfile.Dispenser, min, max int) ([]string, bool, error) {
+	args := c.RemainingArgs()
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return nil, false, c.ArgErr()
+	}
+	if !c.NextArg() {
+		return args, false, nil
+	}
+	// RemainingArgs stops at the opening brace, the brace is the last token of the line
+	if c.NextArg() {
+		return nil, false, c.Errf("Unexpected token '%s' after '{'", c.Val())
+	}
+	return args, true, nil
+}
+
+// lineArgs returns the arguments of the current line, like blockArgs, but the line must not open a block.
+func lineArgs(c *caddyfile.Dispenser, min, max int) ([]string, error) {
+	directive := c.Val()
+	args, block, err := blockArgs(c, min, max)
+	if err != nil {
+		return nil, err
+	}
+	if block {
+		return nil, c.Errf("'%s' does not take a block", directive)
+	}
+	return args, nil
+}
+
+// parseBlock calls parse for every line of a nested block until its closing brace.
+func parseBlock(c *caddyfile.Dispenser, parse func() error) error {
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := parse(); err != nil {
+			return err
+		}
+	}
+	return c.EOFErr()
+}
+
+// parseSOA parses the SOA block, the timers are in seconds or in the duration syntax.
+func parseSOA(c *caddyfile.Dispenser, soa *soaConfig) error {
+	_, block, err := blockArgs(c, 0, 0)
+	if err != nil {
+		return err
+	}
+	if !block {
+		return c.Err("SOA needs a block")
+	}
+	return parseBlock(c, func() error {
+		property := strings.ToLower(c.Val())
+		switch property {
+		case "mname", "rname", "refresh", "retry", "expire", "minimum":
+		default:
+			return c.Errf("Unknown property '%s'", c.Val())
+		}
+		args, err := lineArgs(c, 1, 1)
+		if err != nil {
+			return err
+		}
+		switch property {
+		case "mname":
+			if soa.MName, err = parseDomain(args[0]); err != nil {
+				return c.Err(err.Error())
+			}
+			return nil
+		case "rname":
+			if soa.RName, err = parseMailbox(args[0]); err != nil {
+				return c.Err(err.Error())
+			}
+			return nil
+		}
+		value, err := parseTTL(args[0])
+		if err != nil || value <= 0 {
+			return c.Errf("Invalid %s value: '%s'", property, args[0])
+		}
+		switch property {
+		case "refresh":
+			soa.Refresh = value
+		case "retry":
+			soa.Retry = value
+		case "expire":
+			soa.Expire = value
+		case "minimum":
+			soa.Minimum = value
+		}
+		return nil
+	})
+}
+
+// parseTransfer parses the Transfer block.
+func parseTransfer(c *caddyfile.Dispenser) (*transferConfig, error) {
+	if _, block, err := blockArgs(c, 0, 0); err != nil {
+		return nil, err
+	} else if !block {
+		return nil, c.Err("Transfer needs a block")
+	}
+	transfer := &transferConfig{}
+	err := parseBlock(c, func() error {
+		if strings.EqualFold(c.Val(), "to") {
+			args, err := lineArgs(c, 1, -1)
+			if err != nil {
+				return err
+			}
+			for _, arg := range args {
+				if arg != "*" && net.ParseIP(arg) == nil {
+					if _, _, err := net.ParseCIDR(arg); err != nil {
+						return c.Errf("Invalid transfer address: '%s'", arg)
+					}
+				}
+				transfer.To = append(transfer.To, arg)
+			}
+		} else if strings.EqualFold(c.Val(), "notify") {
+			args, err := lineArgs(c, 1, -1)
+			if err != nil {
+				return err
+			}
+			for _, arg := range args {
+				if _, _, err := net.SplitHostPort(arg); err != nil {
+					arg = net.JoinHostPort(arg, "53")
+				}
+				if host, _, err := net.SplitHostPort(arg); err != nil || host == "" {
+					return c.Errf("Invalid notify address: '%s'", arg)
+				}
+				transfer.Notify = append(transfer.Notify, arg)
+			}
+		} else if strings.EqualFold(c.Val(), "tsig") {
+			args, err := lineArgs(c, 3, 3)
+			if err != nil {
+				return err
+			}
+			if transfer.TSIGKey, err = parseDomain(args[0]); err != nil {
+				return c.Err(err.Error())
+			}
+			var ok bool
+			if transfer.TSIGAlgorithm, ok = tsigAlgorithms[strings.ToLower(strings.TrimSuffix(args[1], "."))]; !ok {
+				return c.Errf("Invalid tsig algorithm: '%s'", args[1])
+			}
+			if transfer.TSIGSecret, err = expandEnv(args[2]); err != nil {
+				return c.Err(err.Error())
+			}
+			if _, err := base64.StdEncoding.DecodeString(transfer.TSIGSecret); err != nil || transfer.TSIGSecret == "" {
+				return c.Err("Invalid tsig secret, it must be base64 encoded")
+			}
+		} else {
+			return c.Errf("Unknown property '%s'", c.Val())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(transfer.To) == 0 && len(transfer.Notify) == 0 {
+		return nil, c.Err("Transfer needs at least one 'to' or 'notify' address")
+	}
+	return transfer, nil
+}
+
+// parseMailbox parses the rname of a SOA record, given as domain name (`hostmaster.lan.local`)
+// or as mail address (`hostmaster@lan.local`).
+func parseMailbox(s string) (string, error) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return parseDomain(s)
+	}
+	domain, err := parseDomain(s[i+1:])
+	if err != nil {
+		return "", err
+	}
+	local := s[:i]
+	if local == "" || strings.ContainsAny(local, " \\") {
+		return "", fmt.Errorf("'%s' is not a valid mailbox", s)
+	}
+	// dots in the local part are escaped, the first label is the local part
+	return strings.ReplaceAll(local, ".", "\\.") + "." + domain, nil
+}
+
+// parseNetwork parses the arguments of a network line (`Network LAN lan.local`) into networks,
+// the ipv6 address selection of an optional block is parsed into policies.
+func parseNetwork(c *caddyfile.Dispenser, networks map[string]string, policies map[string]ipv6Policy) error {
+	args, block, err := blockArgs(c, 2, 2)
+	if err != nil {
+		return err
+	}
+	network := strings.ToLower(args[0])
+	if _, ok := networks[network]; ok {
+		return c.Errf("Duplicate network '%s'", args[0])
+	}
+	domain, err := parseDomain(args[1])
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	networks[network] = domain
+	if block {
+		policy, err := parseIPv6Policy(c)
+		if err != nil {
+			return err
+		}
+		policies[network] = policy
+	}
+	return nil
+}
+
+// parseIPv6Policy parses the block of a network line.
+func parseIPv6Policy(c *caddyfile.Dispenser) (ipv6Policy, error) {
+	policy := ipv6Policy{
+		Scope: ipv6All,
+	}
+	err := parseBlock(c, func() error {
+		if strings.EqualFold(c.Val(), "ipv6") {
+			args, err := lineArgs(c, 1, 1)
+			if err != nil {
+				return err
+			}
+			switch scope := strings.ToLower(args[0]); scope {
+			case ipv6All, ipv6Global, ipv6ULA:
+				policy.Scope = scope
+			default:
+				return c.Errf("Invalid IPv6 value: '%s'", args[0])
+			}
+		} else if strings.EqualFold(c.Val(), "excludetemporary") {
+			if _, err := lineArgs(c, 0, 0); err != nil {
+				return err
+			}
+			policy.ExcludeTemporary = true
+		} else if strings.EqualFold(c.Val(), "maxaaaa") {
+			args, err := lineArgs(c, 1, 1)
+			if err != nil {
+				return err
+			}
+			max, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil {
+				return c.Errf("Invalid MaxAAAA value: '%s'", args[0])
+			}
+			policy.Max = int(max)
+		} else {
+			return c.Errf("Unknown property '%s'", c.Val())
+		}
+		return nil
+	})
+	return policy, err
+}
+
+// parseDomain validates domain and returns it in its fully qualified form.
+func parseDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if !govalidator.IsDNSName(domain) {
+		return "", fmt.Errorf("'%s' is not a valid domain name", domain)
+	}
+	return domain + ".", nil
+}
+
+// parseReverseZone parses a reverse zone given by its name (`168.192.in-addr.arpa`) or by its network
+// (`192.168.0.0/16`), networks must end on an octet (ipv4) or nibble (ipv6) boundary.
+func parseReverseZone(s string) (string, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		ones, bits := network.Mask.Size()
+		var labels []string
+		if bits == 32 {
+			if ones%8 != 0 {
+				return "", fmt.Errorf("'%s' does not end on an octet boundary", s)
+			}
+			for i := ones/8 - 1; i >= 0; i-- {
+				labels = append(labels, strconv.Itoa(int(network.IP[i])))
+			}
+			return strings.Join(append(labels, "in-addr.arpa."), "."), nil
+		}
+		if ones%4 != 0 {
+			return "", fmt.Errorf("'%s' does not end on a nibble boundary", s)
+		}
+		for i := ones/4 - 1; i >= 0; i-- {
+			nibble := network.IP[i/2] & 0x0f
+			if i%2 == 0 {
+				nibble = network.IP[i/2] >> 4
+			}
+			labels = append(labels, strconv.FormatUint(uint64(nibble), 16))
+		}
+		return strings.Join(append(labels, "ip6.arpa."), "."), nil
+	}
+
+	zone, err := parseDomain(s)
+	if err != nil {
+		return "", err
+	}
+	if !dns.IsSubDomain("in-addr.arpa.", zone) && !dns.IsSubDomain("ip6.arpa.", zone) {
+		return "", fmt.Errorf("'%s' is not a reverse zone", s)
+	}
+	return zone, nil
+}
+
+// domains returns all domains of the controller.
+func (c *controllerConfig) domains() []string {
+	domains := make([]string, 0, len(c.Networks))
+	for _, domain := range c.Networks {
+		domains = append(domains, domain)
+	}
+	for _, networks := range c.Sites {
+		for _, domain := range networks {
+			domains = append(domains, domain)
+		}
+	}
+	if c.DevicesDomain != "" {
+		domains = append(domains, c.DevicesDomain)
+	}
+	return domains
+}
+
+// domains returns all configured domains.
+func (c *config) domains() []string {
+	var domains []string
+	for _, controller := range c.Controllers {
+		domains = append(domains, controller.domains()...)
+	}
+	return domains
 }
@@ -1,11 +1,18 @@
 package unifinames
 
 import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	"bytes"
 
 	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -18,6 +25,7 @@ func TestNewConfigFromDispenser(t *testing.T) {
 				Network VLAN2 example3.com
 				Unifi https://localhost:8443/ default admin test deadbeef
 				TTL 60
+				UnifiType UniFiOS
 				Debug
 			}
 		`)))
@@ -28,14 +36,15 @@ func TestNewConfigFromDispenser(t *testing.T) {
 			"lan":   "example1.com.",
 			"vlan1": "example2.com.",
 			"vlan2": "example3.com.",
-		}, config.Networks)
+		}, config.Controllers[0].Networks)
 		require.Equal(t, uint32(60), config.TTL)
 		require.Equal(t, true, config.Debug)
-		require.Equal(t, "https://localhost:8443", config.UnifiControllerURL)
-		require.Equal(t, "default", config.UnifiSite)
-		require.Equal(t, "admin", config.UnifiUsername)
-		require.Equal(t, "test", config.UnifiPassword)
-		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, config.UnifiSSLFingerprint)
+		require.Equal(t, "https://localhost:8443", config.Controllers[0].URL)
+		require.Equal(t, "default", config.Controllers[0].Site)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+		require.Equal(t, "test", config.Controllers[0].Password)
+		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, config.Controllers[0].SSLFingerprint)
+		require.Equal(t, controllerUnifiOS, config.Controllers[0].Type)
 	})
 	t.Run("Emtpy Config", func(t *testing.T) {
 		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
@@ -64,14 +73,15 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		require.NotNil(t, config)
 		require.Equal(t, map[string]string{
 			"lan": "example1.com.",
-		}, config.Networks)
+		}, config.Controllers[0].Networks)
 		require.Equal(t, uint32(60*60), config.TTL)
 		require.Equal(t, false, config.Debug)
-		require.Equal(t, "https://localhost:8443", config.UnifiControllerURL)
-		require.Equal(t, "default", config.UnifiSite)
-		require.Equal(t, "admin", config.UnifiUsername)
-		require.Equal(t, "test", config.UnifiPassword)
-		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, config.UnifiSSLFingerprint)
+		require.Equal(t, "https://localhost:8443", config.Controllers[0].URL)
+		require.Equal(t, "default", config.Controllers[0].Site)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+		require.Equal(t, "test", config.Controllers[0].Password)
+		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, config.Controllers[0].SSLFingerprint)
+		require.Equal(t, controllerAuto, config.Controllers[0].Type)
 	})
 	t.Run("Invalid Network", func(t *testing.T) {
 		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
@@ -106,4 +116,1068 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		require.Error(t, err)
 		require.Nil(t, config)
 	})
+	t.Run("Invalid UnifiType", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				UnifiType cloud
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("API Key", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+				APIKey secretkey
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "secretkey", config.Controllers[0].APIKey)
+		require.Equal(t, "", config.Controllers[0].Username)
+		require.Equal(t, "", config.Controllers[0].Password)
+	})
+	t.Run("API Key File", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "apikey")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString("secretkey\n")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+				APIKeyFile `+f.Name()+`
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "secretkey", config.Controllers[0].APIKey)
+	})
+	t.Run("Missing Credentials", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Sites", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Site office {
+					Network LAN office.example.com
+					Network VLAN1 vlan.office.example.com
+				}
+				Site lab {
+					Network LAN lab.example.com
+				}
+				AllSites
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{
+			"lan": "example.com.",
+		}, config.Controllers[0].Networks)
+		require.Equal(t, map[string]map[string]string{
+			"office": {
+				"lan":   "office.example.com.",
+				"vlan1": "vlan.office.example.com.",
+			},
+			"lab": {
+				"lan": "lab.example.com.",
+			},
+		}, config.Controllers[0].Sites)
+		require.True(t, config.Controllers[0].AllSites)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+	})
+	t.Run("Only Sites", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Site office {
+					Network LAN office.example.com
+				}
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{}, config.Controllers[0].Networks)
+		require.Equal(t, 1, len(config.Controllers[0].Sites))
+	})
+	t.Run("Multiple Controllers", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				UnifiType legacy
+				Unifi https://building1:8443/ default admin test deadbeef
+				Unifi https://building2/ default {
+					Network LAN building2.example.com
+					Site office {
+						Network LAN office.building2.example.com
+					}
+					UnifiType UniFiOS
+					APIKey secretkey
+				}
+				TTL 60
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, uint32(60), config.TTL)
+		require.Equal(t, 2, len(config.Controllers))
+
+		require.Equal(t, "https://building1:8443", config.Controllers[0].URL)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, config.Controllers[0].SSLFingerprint)
+		require.Equal(t, map[string]string{"lan": "example.com."}, config.Controllers[0].Networks)
+		require.Equal(t, controllerLegacy, config.Controllers[0].Type)
+
+		require.Equal(t, "https://building2", config.Controllers[1].URL)
+		require.Equal(t, "default", config.Controllers[1].Site)
+		require.Equal(t, "secretkey", config.Controllers[1].APIKey)
+		require.Equal(t, map[string]string{"lan": "building2.example.com."}, config.Controllers[1].Networks)
+		require.Equal(t, map[string]map[string]string{
+			"office": {"lan": "office.building2.example.com."},
+		}, config.Controllers[1].Sites)
+		require.Equal(t, controllerUnifiOS, config.Controllers[1].Type)
+	})
+	t.Run("Failover", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://primary:8443/ default admin test
+				Failover https://standby1:8443/ https://standby2:8443
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "https://primary:8443", config.Controllers[0].URL)
+		require.Equal(t, []string{"https://standby1:8443", "https://standby2:8443"}, config.Controllers[0].FailoverURLs)
+
+		// the standby belongs to one controller
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://primary:8443/ default admin test {
+					Failover https://standby1:8443/
+				}
+				Unifi https://building2:8443/ default admin test {
+					Network LAN building2.example.com
+				}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"https://standby1:8443"}, config.Controllers[0].FailoverURLs)
+		require.Empty(t, config.Controllers[1].FailoverURLs)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Failover https://standby1:8443/
+				Unifi https://primary:8443/ default admin test
+				Unifi https://building2:8443/ default admin test {
+					Network LAN building2.example.com
+				}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), ":4 - Error during parsing: Failover outside of an Unifi block needs a single controller")
+		require.Nil(t, config)
+	})
+	t.Run("History", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				History 168h
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, 168*time.Hour, config.Controllers[0].HistoryRetention)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				History forever
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Reservations", func(t *testing.T) {
+		for value, preferObserved := range map[string]bool{"": false, "reserved": false, "observed": true} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					Reservations `+value+`
+				}
+			`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.NoError(t, err)
+			require.True(t, config.Controllers[0].Reservations)
+			require.Equal(t, preferObserved, config.Controllers[0].PreferObservedIP)
+		}
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Reservations always
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Devices", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Devices infra.example.com
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.True(t, config.Controllers[0].Devices)
+		require.Equal(t, "infra.example.com.", config.Controllers[0].DevicesDomain)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Devices
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.True(t, config.Controllers[0].Devices)
+		require.Equal(t, "", config.Controllers[0].DevicesDomain)
+	})
+
+	t.Run("AutoNetworks", func(t *testing.T) {
+		// no explicit networks are needed
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				AutoNetworks
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.True(t, config.Controllers[0].AutoNetworks)
+		require.Empty(t, config.Controllers[0].Networks)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Events
+				Unifi https://building1:8443/ default admin test
+				Unifi https://building2:8443/ default admin test
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.True(t, config.Controllers[0].Events)
+		require.True(t, config.Controllers[1].Events)
+	})
+
+	t.Run("IPv6 Policies", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com {
+					IPv6 global
+					ExcludeTemporary
+					MaxAAAA 2
+				}
+				Network Guest guest.example.com
+				Site office {
+					Network LAN office.example.com {
+						IPv6 ULA
+					}
+				}
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{
+			"lan":   "example.com.",
+			"guest": "guest.example.com.",
+		}, config.Controllers[0].Networks)
+		require.Equal(t, map[string]ipv6Policy{
+			"lan": {Scope: ipv6Global, ExcludeTemporary: true, Max: 2},
+		}, config.Controllers[0].IPv6Policies)
+		require.Equal(t, map[string]map[string]ipv6Policy{
+			"office": {
+				"lan": {Scope: ipv6ULA},
+			},
+		}, config.Controllers[0].SiteIPv6Policies)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com {
+					IPv6 site-local
+				}
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("TOTP Secret File", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "totp")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TOTPSecretFile `+f.Name()+`
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []byte("12345678901234567890"), config.Controllers[0].TOTPSecret)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TOTPSecretFile /does/not/exist
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("Environment Variables", func(t *testing.T) {
+		require.NoError(t, os.Setenv("UNIFI_TEST_USER", "admin"))
+		require.NoError(t, os.Setenv("UNIFI_TEST_PASSWORD", "secret"))
+		defer os.Unsetenv("UNIFI_TEST_USER")
+		defer os.Unsetenv("UNIFI_TEST_PASSWORD")
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default {env.UNIFI_TEST_USER} pre-{env.UNIFI_TEST_PASSWORD}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+		require.Equal(t, "pre-secret", config.Controllers[0].Password)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+				APIKey {env.UNIFI_TEST_PASSWORD}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "secret", config.Controllers[0].APIKey)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin {env.UNIFI_TEST_NOT_SET}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.EqualError(t, err, ":4 - Error during parsing: environment variable `UNIFI_TEST_NOT_SET' is not set")
+		require.Nil(t, config)
+	})
+	t.Run("Credential Files", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "credentials")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		require.NoError(t, ioutil.WriteFile(dir+"/username", []byte("admin\n"), 0600))
+		require.NoError(t, ioutil.WriteFile(dir+"/password", []byte("secret\n"), 0600))
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default {
+					username_file `+dir+`/username
+					PasswordFile `+dir+`/password
+				}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+		require.Equal(t, "secret", config.Controllers[0].Password)
+
+		// the files are read again when they change
+		require.NoError(t, ioutil.WriteFile(dir+"/password", []byte("rotated-secret\n"), 0600))
+		require.Equal(t, "rotated-secret", secret(config.Controllers[0].Password, config.Controllers[0].PasswordFile))
+
+		// the last value that was read is kept if the file goes missing
+		require.NoError(t, os.Rename(dir+"/password", dir+"/password.old"))
+		require.Equal(t, "rotated-secret", secret(config.Controllers[0].Password, config.Controllers[0].PasswordFile))
+		require.NoError(t, os.Rename(dir+"/password.old", dir+"/password"))
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin
+				password_file `+dir+`/does-not-exist
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("Structured Unifi Block", func(t *testing.T) {
+		s := httptest.NewTLSServer(http.NotFoundHandler())
+		defer s.Close()
+		f, err := ioutil.TempFile("", "ca")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}))
+		require.NoError(t, f.Close())
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi {
+					url https://localhost:8443/
+					site office
+					username admin
+					password test
+					fingerprint de:ad:be:ef
+					ca `+f.Name()+`
+					timeout 10s
+					auth password
+					refresh 5m
+					APIKey secretkey
+				}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "https://localhost:8443", config.Controllers[0].URL)
+		require.Equal(t, "office", config.Controllers[0].Site)
+		require.Equal(t, "admin", config.Controllers[0].Username)
+		require.Equal(t, "test", config.Controllers[0].Password)
+		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, config.Controllers[0].SSLFingerprint)
+		require.NotNil(t, config.Controllers[0].RootCAs)
+		require.Equal(t, 10*time.Second, config.Controllers[0].Timeout)
+		require.Equal(t, 5*time.Minute, config.Controllers[0].Refresh)
+		require.Equal(t, authPassword, config.Controllers[0].AuthMode)
+		require.False(t, config.Controllers[0].useAPIKey())
+
+		// the block overrides the one-line form
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test {
+					site office
+					password secret
+				}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "https://localhost:8443", config.Controllers[0].URL)
+		require.Equal(t, "office", config.Controllers[0].Site)
+		require.Equal(t, "secret", config.Controllers[0].Password)
+
+		// the api key auth needs an api key
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi {
+					url https://localhost:8443/
+					site default
+					auth apikey
+				}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+
+		for _, property := range []string{"timeout 10", "refresh -1m", "auth oauth", "ca /does/not/exist", "fingerprint xyz"} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test {
+						`+property+`
+					}
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Strict Validation", func(t *testing.T) {
+		for name, test := range map[string]struct {
+			config string
+			err    string
+		}{
+			"unknown property": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Netwrok VLAN vlan.example.com`,
+				":4 - Error during parsing: Unknown property 'Netwrok'",
+			},
+			"unknown property in unifi block": {`
+				Unifi https://localhost:8443/ default admin test {
+					Network LAN example.com
+					usr admin
+				}`,
+				":4 - Error during parsing: Unknown property 'usr'",
+			},
+			"unknown property in site block": {`
+				Unifi https://localhost:8443/ default admin test
+				Site office {
+					Network LAN example.com
+					TTL 60
+				}`,
+				":5 - Error during parsing: Unknown property 'TTL'",
+			},
+			"unknown property in network block": {`
+				Unifi https://localhost:8443/ default admin test
+				Network LAN example.com {
+					IPv4 global
+				}`,
+				":4 - Error during parsing: Unknown property 'IPv4'",
+			},
+			"network without domain": {`
+				Unifi https://localhost:8443/ default admin test
+				Network LAN`,
+				":3 - Error during parsing: Wrong argument count or unexpected line ending after 'LAN'",
+			},
+			"network with too many arguments": {`
+				Unifi https://localhost:8443/ default admin test
+				Network LAN example.com lan.example.com`,
+				":3 - Error during parsing: Wrong argument count or unexpected line ending after 'lan.example.com'",
+			},
+			"ttl without value": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TTL`,
+				":4 - Error during parsing: Wrong argument count or unexpected line ending after 'TTL'",
+			},
+			"flag with argument": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Debug yes`,
+				":4 - Error during parsing: Wrong argument count or unexpected line ending after 'yes'",
+			},
+			"unifi with too many arguments": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef extra`,
+				":3 - Error during parsing: Wrong argument count or unexpected line ending after 'extra'",
+			},
+			"block on a line without block": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Devices {
+				}`,
+				":4 - Error during parsing: 'Devices' does not take a block",
+			},
+			"duplicate network": {`
+				Network LAN example.com
+				Network lan lan.example.com
+				Unifi https://localhost:8443/ default admin test`,
+				":3 - Error during parsing: Duplicate network 'lan'",
+			},
+			"duplicate site": {`
+				Unifi https://localhost:8443/ default admin test
+				Site office {
+					Network LAN office.example.com
+				}
+				Site office {
+					Network VLAN vlan.office.example.com
+				}`,
+				":6 - Error during parsing: Duplicate site 'office'",
+			},
+			"duplicate controller": {`
+				Unifi https://localhost:8443/ default admin test {
+					Network LAN example.com
+				}
+				Unifi https://localhost:8443 default admin test {
+					Network LAN building2.example.com
+				}`,
+				":5 - Error during parsing: Controller 'https://localhost:8443' with site 'default' is already set up at :2",
+			},
+			"duplicate zone of sites": {`
+				Unifi https://localhost:8443/ default admin test
+				Network LAN example.com
+				Site office {
+					Network LAN example.com
+				}`,
+				":2 - Error during parsing: Zone 'example.com.' is already served by another site or controller",
+			},
+			"duplicate zone of controllers": {`
+				Unifi https://building1:8443/ default admin test {
+					Network LAN example.com
+				}
+				Unifi https://building2:8443/ default admin test {
+					Network LAN example.com
+				}`,
+				":5 - Error during parsing: Zone 'example.com.' is already served by another site or controller",
+			},
+			"zone of inherited networks": {`
+				Network LAN example.com
+				Unifi https://building1:8443/ default admin test
+				Unifi https://building2:8443/ default admin test {
+					Network LAN example.com
+				}`,
+				":4 - Error during parsing: Zone 'example.com.' is already served by another site or controller",
+			},
+			"duplicate property": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TTL 60
+				TTL 120`,
+				":5 - Error during parsing: Duplicate property 'TTL', it is already set at :4",
+			},
+			"duplicate controller property": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Timeout 10s
+				timeout 20s`,
+				":5 - Error during parsing: Duplicate property 'timeout', it is already set at :4",
+			},
+			"duplicate property in unifi block": {`
+				Unifi https://localhost:8443/ default admin test {
+					Network LAN example.com
+					password secret1
+					password secret2
+				}`,
+				":5 - Error during parsing: Duplicate property 'password', it is already set at :4",
+			},
+			"duplicate api key": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+				APIKey key
+				APIKey other`,
+				":5 - Error during parsing: Duplicate property 'APIKey', it is already set at :4",
+			},
+			"unused networks": {`
+				Network LAN lan.example.com
+				Unifi https://localhost:8443/ default admin test {
+					Network LAN example.com
+				}`,
+				":2 - Error during parsing: Networks outside of an Unifi block are not used, every controller sets its own networks",
+			},
+			"unused sites": {`
+				Unifi https://localhost:8443/ default admin test {
+					Network LAN example.com
+				}
+				Site office {
+					Network LAN office.example.com
+				}`,
+				":5 - Error during parsing: Networks outside of an Unifi block are not used, every controller sets its own networks",
+			},
+			"url without scheme": {`
+				Network LAN example.com
+				Unifi localhost:8443 default admin test`,
+				":3 - Error during parsing: Invalid controller url: 'localhost:8443'",
+			},
+			"url with unsupported scheme": {`
+				Network LAN example.com
+				Unifi {
+					url ftp://localhost:8443
+				}`,
+				":4 - Error during parsing: Invalid controller url: 'ftp://localhost:8443'",
+			},
+			"failover url without host": {`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Failover https://standby:8443/ https://`,
+				":4 - Error during parsing: Invalid controller url: 'https://'",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`{`+test.config+`
+				}`)))
+				config, err := newConfigFromDispenser(dispenser)
+				require.Error(t, err)
+				require.Contains(t, err.Error(), test.err)
+				require.Nil(t, config)
+			})
+		}
+	})
+
+	t.Run("TTL And Refresh", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TTL 5m
+				Refresh 1m
+				MinTTL 10
+				ServeStale 2h 15s
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, uint32(300), config.TTL)
+		require.Equal(t, time.Minute, config.Refresh)
+		require.Equal(t, 10*time.Second, config.MinTTL)
+		require.Equal(t, 2*time.Hour, config.MaxStale)
+		require.Equal(t, 15*time.Second, config.StaleTTL)
+
+		// defaults
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, uint32(3600), config.TTL)
+		require.Equal(t, time.Duration(0), config.Refresh)
+		require.Equal(t, time.Hour, config.MaxStale)
+		require.Equal(t, 30*time.Second, config.StaleTTL)
+
+		// a ttl of 0 needs its own refresh rate
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TTL 0
+				Refresh 5m
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, uint32(0), config.TTL)
+
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				TTL 0
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.EqualError(t, err, ":5 - Error during parsing: TTL 0 needs a Refresh rate, the refresh rate defaults to the TTL")
+		require.Nil(t, config)
+
+		for _, property := range []string{"TTL -1m", "TTL 200000000h", "Refresh 0s", "MinTTL soon", "ServeStale -1h", "ServeStale 1h 1h 1h"} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Retry And Circuit Breaker", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Timeout 20s
+				Retry 5 2s 1m
+				CircuitBreaker 2 1h
+				Unifi https://localhost:8443/ default admin test
+				Unifi https://localhost:8443/ office admin test {
+					Network LAN office.example.com
+					timeout 5s
+					Retry 1
+					CircuitBreaker off
+				}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, 20*time.Second, config.Controllers[0].Timeout)
+		require.Equal(t, 5, config.Controllers[0].RetryAttempts)
+		require.Equal(t, 2*time.Second, config.Controllers[0].RetryMinBackoff)
+		require.Equal(t, time.Minute, config.Controllers[0].RetryMaxBackoff)
+		require.Equal(t, 2, config.Controllers[0].BreakerThreshold)
+		require.Equal(t, time.Hour, config.Controllers[0].BreakerCooldown)
+		require.Equal(t, 5*time.Second, config.Controllers[1].Timeout)
+		require.Equal(t, 1, config.Controllers[1].RetryAttempts)
+		require.Equal(t, -1, config.Controllers[1].BreakerThreshold)
+
+		// defaults
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(0), config.Controllers[0].Timeout)
+		require.Equal(t, 3, config.Controllers[0].RetryAttempts)
+		require.Equal(t, time.Second, config.Controllers[0].RetryMinBackoff)
+		require.Equal(t, 30*time.Second, config.Controllers[0].RetryMaxBackoff)
+		require.Equal(t, 3, config.Controllers[0].BreakerThreshold)
+		require.Equal(t, 15*time.Minute, config.Controllers[0].BreakerCooldown)
+
+		for _, property := range []string{"Timeout 0s", "Retry 0", "Retry 3 soon", "Retry 3 1m 1s", "CircuitBreaker 0", "CircuitBreaker 3 -1m", "CircuitBreaker off 1m"} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Cache File", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				CacheFile /var/lib/coredns/unifi-names.json 12h
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "/var/lib/coredns/unifi-names.json", config.CacheFile)
+		require.Equal(t, 12*time.Hour, config.CacheMaxAge)
+
+		for _, property := range []string{"CacheFile", "CacheFile /tmp/cache.json 0s", "CacheFile /tmp/cache.json old"} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Reverse Zones", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				ReverseZones 192.168.0.0/16 10.0.0.0/8
+				ReverseZones 2001:db8::/32 fd00::/8 172.16.in-addr.arpa
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"168.192.in-addr.arpa.",
+			"10.in-addr.arpa.",
+			"8.b.d.0.1.0.0.2.ip6.arpa.",
+			"d.f.ip6.arpa.",
+			"172.16.in-addr.arpa.",
+		}, config.ReverseZones)
+
+		for _, property := range []string{"ReverseZones", "ReverseZones 192.168.0.0/20", "ReverseZones fd00::/7", "ReverseZones example.com"} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Fallthrough", func(t *testing.T) {
+		for property, zones := range map[string][]string{
+			"":                                      nil,
+			"Fallthrough":                           {"."},
+			"Fallthrough lan.local 10.in-addr.arpa": {"lan.local.", "10.in-addr.arpa."},
+		} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.NoError(t, err, property)
+			require.Equal(t, zones, config.Fall.Zones, property)
+		}
+	})
+
+	t.Run("SOA And NS", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				NS ns1.example.com ns2.example.com.
+				SOA {
+					mname ns1.example.com
+					rname dns.admin@example.com
+					refresh 1h
+					retry 600
+					expire 1000h
+					minimum 30s
+				}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, config.NS)
+		require.Equal(t, soaConfig{
+			MName:   "ns1.example.com.",
+			RName:   "dns\\.admin.example.com.",
+			Refresh: time.Hour,
+			Retry:   10 * time.Minute,
+			Expire:  1000 * time.Hour,
+			Minimum: 30 * time.Second,
+		}, config.SOA)
+
+		for _, property := range []string{"NS", "NS -.-", "SOA", "SOA {\nserial 1\n}", "SOA {\nrefresh 0\n}", "SOA {\nrname @example.com\n}", "SOA {\nmname\n}"} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Transfer", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				NS ns1.example.com
+				Transfer {
+					to 192.168.1.2 10.0.0.0/8
+					notify 192.168.1.2 [::1]:5353
+					tsig secondary. HMAC-SHA256 c2Vjb25kYXJ5IHNlY3JldA==
+				}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, &transferConfig{
+			To:            []string{"192.168.1.2", "10.0.0.0/8"},
+			Notify:        []string{"192.168.1.2:53", "[::1]:5353"},
+			TSIGKey:       "secondary.",
+			TSIGAlgorithm: dns.HmacSHA256,
+			TSIGSecret:    "c2Vjb25kYXJ5IHNlY3JldA==",
+		}, config.Transfer)
+
+		// the secondaries need the name servers
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				Transfer {
+					to *
+				}
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.EqualError(t, err, ":5 - Error during parsing: Transfer needs NS or the mname of the SOA")
+		require.Nil(t, config)
+
+		for _, property := range []string{
+			"Transfer",
+			"Transfer {\n}",
+			"Transfer {\nto\n}",
+			"Transfer {\nto 192.168.1\n}",
+			"Transfer {\nnotify :53\n}",
+			"Transfer {\nto *\ntsig secondary hmac-sha3 c2VjcmV0\n}",
+			"Transfer {\nto *\ntsig secondary hmac-sha256 not-base64\n}",
+			"Transfer {\nto *\nfrom *\n}",
+		} {
+			dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					NS ns1.example.com
+					`+property+`
+				}
+			`)))
+			config, err = newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		for property, order := range map[string]string{
+			"":                  orderFixed,
+			"Order fixed":       orderFixed,
+			"Order Round-Robin": orderRoundRobin,
+			"Order shuffle":     orderShuffle,
+		} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.NoError(t, err, property)
+			require.Equal(t, order, config.Order, property)
+		}
+
+		for _, property := range []string{"Order", "Order random", "Order fixed shuffle"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test
+					`+property+`
+				}
+			`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, property)
+			require.Nil(t, config, property)
+		}
+	})
 }
@@ -0,0 +1,249 @@
+package unifinames
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	// eventsMinBackoff is the delay before the event stream is reopened, it doubles on every failed attempt
+	eventsMinBackoff = time.Second
+	// eventsMaxBackoff is the maximum delay before the event stream is reopened
+	eventsMaxBackoff = 5 * time.Minute
+)
+
+// connectEvents are the event keys of clients that connected.
+var connectEvents = map[string]bool{
+	"EVT_WU_Connected": true,
+	"EVT_LU_Connected": true,
+	"EVT_WG_Connected": true,
+}
+
+// disconnectEvents are the event keys of clients that disconnected.
+var disconnectEvents = map[string]bool{
+	"EVT_WU_Disconnected": true,
+	"EVT_LU_Disconnected": true,
+	"EVT_WG_Disconnected": true,
+}
+
+// eventMessage is a message of the event stream.
+type eventMessage struct {
+	Meta struct {
+		RC      string
+		Message string
+	}
+	Data []json.RawMessage
+}
+
+// watchSites starts an event routine for every site of ctrl that has records and stops the routines of
+// sites that are gone.
+func (p *unifinames) watchSites(ctrl *controller) {
+	p.mu.Lock()
+	sites := make(map[string]struct{})
+	prefix := ctrl.key("")
+	for key := range p.records {
+		if strings.HasPrefix(key, prefix) {
+			sites[strings.TrimPrefix(key, prefix)] = struct{}{}
+		}
+	}
+	p.mu.Unlock()
+
+	if ctrl.watching == nil {
+		ctrl.watching = make(map[string]context.CancelFunc)
+	}
+	for site, cancel := range ctrl.watching {
+		if _, ok := sites[site]; !ok {
+			cancel()
+			delete(ctrl.watching, site)
+		}
+	}
+	for site := range sites {
+		if _, ok := ctrl.watching[site]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		ctrl.watching[site] = cancel
+		go p.eventRoutine(ctx, ctrl, site)
+	}
+}
+
+// eventRoutine applies the events of site until ctx is done or the plugin is closed,
+// the stream is reopened with backoff when it drops.
+func (p *unifinames) eventRoutine(ctx context.Context, ctrl *controller, site string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := eventsMinBackoff
+	for {
+		connected, err := p.streamEvents(ctx, ctrl, site)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = eventsMinBackoff
+		}
+		log.Printf("[unifi-names] event stream of site `%s' of `%s' dropped: %v, reconnecting in %s\n", site, ctrl.config.URL, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > eventsMaxBackoff {
+			backoff = eventsMaxBackoff
+		}
+	}
+}
+
+// streamEvents opens the event stream of site and applies the events until the stream drops,
+// it reports whether the stream was opened.
+func (p *unifinames) streamEvents(ctx context.Context, ctrl *controller, site string) (bool, error) {
+	conn, err := ctrl.unifi.events(ctx, site)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if p.Config.Debug {
+		log.Printf("[unifi-names] listening to events of site `%s' of `%s'\n", site, ctrl.config.URL)
+	}
+	for {
+		var buf []byte
+		if err := websocket.Message.Receive(conn, &buf); err != nil {
+			return true, err
+		}
+		var msg eventMessage
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			log.Printf("[unifi-names] unable to decode event of site `%s': %v\n", site, err)
+			continue
+		}
+		p.applyEvent(ctrl, site, &msg)
+	}
+}
+
+// applyEvent applies connects, disconnects, renames and ip changes to the records of site.
+func (p *unifinames) applyEvent(ctrl *controller, site string, msg *eventMessage) {
+	if p.Config.Debug {
+		log.Printf("[unifi-names] got `%s' event with %d entries for site `%s'\n", msg.Meta.Message, len(msg.Data), site)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recs, ok := p.records[ctrl.key(site)]
+	// restored records have no clients to apply the event to, they are kept until a refresh replaces them
+	if !ok || recs.restored {
+		return
+	}
+
+	switch msg.Meta.Message {
+	case "sta:sync":
+		// the current state of connected clients, this covers ip changes
+		for _, data := range msg.Data {
+			var entry client
+			if err := json.Unmarshal(data, &entry); err != nil || entry.MAC == "" || entry.IP == "" {
+				continue
+			}
+			recs.update(ctrl, entry)
+		}
+	case "user:sync":
+		// the settings of known clients, this covers renames
+		for _, data := range msg.Data {
+			var entry client
+			if err := json.Unmarshal(data, &entry); err != nil || entry.MAC == "" {
+				continue
+			}
+			if i := recs.indexOf(entry.MAC); i >= 0 {
+				recs.clients[i].Name = entry.Name
+			}
+		}
+	case "events":
+		for _, data := range msg.Data {
+			var event struct {
+				Key  string
+				User string
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				continue
+			}
+			if connectEvents[event.Key] {
+				// the event has no ip, get the client from the controller
+				ctrl.requestRefresh()
+			} else if disconnectEvents[event.Key] && ctrl.config.HistoryRetention <= 0 && !ctrl.config.Reservations {
+				// with history or reservations the client stays resolvable
+				if i := recs.indexOf(event.User); i >= 0 {
+					recs.clients = append(recs.clients[:i], recs.clients[i+1:]...)
+				}
+			}
+		}
+	default:
+		return
+	}
+	recs.build()
+	p.updateSerials()
+}
+
+// indexOf returns the index of the client with mac, or -1 if there is none.
+func (recs *records) indexOf(mac string) int {
+	for i, entry := range recs.clients {
+		if strings.EqualFold(entry.MAC, mac) {
+			return i
+		}
+	}
+	return -1
+}
+
+// update adds or replaces a connected client, the values the event does not carry are kept.
+func (recs *records) update(ctrl *controller, entry client) {
+	i := recs.indexOf(entry.MAC)
+	if i >= 0 {
+		previous := recs.clients[i]
+		if entry.Name == "" {
+			entry.Name = previous.Name
+		}
+		if entry.Network == "" {
+			entry.Network = previous.Network
+		}
+	}
+	if ctrl.config.Reservations {
+		if i >= 0 && entry.reservation() == "" {
+			entry.UseFixedIP, entry.FixedIP = recs.clients[i].UseFixedIP, recs.clients[i].FixedIP
+		}
+		if fixedIP := entry.reservation(); fixedIP != "" && !ctrl.config.PreferObservedIP {
+			entry.IP = fixedIP
+		}
+	}
+	if i >= 0 {
+		recs.clients[i] = entry
+	} else {
+		recs.clients = append(recs.clients, entry)
+	}
+}
+
+// requestRefresh makes the refresh routine of the controller refresh the clients now.
+func (c *controller) requestRefresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
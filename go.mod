@@ -7,6 +7,8 @@ require (
 	github.com/caddyserver/caddy v1.0.5
 	github.com/coredns/coredns v1.7.0
 	github.com/miekg/dns v1.1.31
+	github.com/prometheus/client_golang v1.6.0
 	github.com/stretchr/testify v1.5.1
 	go.uber.org/atomic v1.6.0
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
 )
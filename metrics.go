@@ -0,0 +1,24 @@
+package unifinames
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// activeEndpoint is 1 for the endpoint of a controller that is currently used and 0 for the others.
+	activeEndpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "unifi_names",
+		Name:      "controller_active_endpoint",
+		Help:      "Gauge which is 1 for the controller endpoint that is currently used.",
+	}, []string{"controller", "endpoint"})
+	// failoverCount is the number of switches to another endpoint of a controller.
+	failoverCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "unifi_names",
+		Name:      "controller_failovers_total",
+		Help:      "Counter of switches to another controller endpoint.",
+	}, []string{"controller"})
+)
@@ -1,78 +1,189 @@
 package unifinames
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
-	"net/http"
-	"net/http/cookiejar"
-	"regexp"
+	"sort"
 
 	"strings"
 
 	"time"
 
-	"crypto/x509"
-
-	"crypto/sha1"
-
 	"sync"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"go.uber.org/atomic"
 )
 
-type unifinames struct {
-	Next        plugin.Handler
-	Config      *config
+// records holds the dns records of one unifi site.
+type records struct {
 	aClients    []dns.A
 	aaaaClients []dns.AAAA
-	lastUpdate  time.Time
+	// domains are the domains the site publishes records in
+	domains    []string
+	lastUpdate time.Time
+	// refresh is the refresh rate of the records
+	refresh time.Duration
+	// restored records were loaded from the cache file, they are served until a refresh succeeds
+	// or they are older than the maximum age of the cache
+	restored bool
+
+	// the sources of the records, they are kept so events can be applied
+	config   siteConfig
+	clients  []client
+	devices  []device
+	networks []network
+}
+
+// controller is a unifi controller that is refreshed on its own.
+type controller struct {
+	id     int
+	config *controllerConfig
+	unifi  *unifiClient
+	// refresh requests an immediate refresh from the refresh routine
+	refresh chan struct{}
+	// watching holds the event routines by site, it is only used by the refresh routine
+	watching map[string]context.CancelFunc
+}
+
+// key returns the lookup table key for the records of site.
+func (c *controller) key(site string) string {
+	return recordsKey(c.id, site)
+}
+
+// recordsKey returns the lookup table key for the records of site of the controller with id.
+func recordsKey(id int, site string) string {
+	return fmt.Sprintf("%d/%s", id, site)
+}
+
+type unifinames struct {
+	Next   plugin.Handler
+	Config *config
+	// records is the lookup table, it holds the records of every site of every controller
+	records     map[string]*records
+	controllers []*controller
 	mu          sync.Mutex
+	once        sync.Once
 	haveRoutine atomic.Bool
+	done        chan struct{}
+	// cacheMu serializes the snapshots and writes of the cache file
+	cacheMu sync.Mutex
+	// serials holds the SOA serials by zone, they are guarded by mu
+	serials map[string]zoneSerial
+	// rotation is the rotation of the records of round-robin answers
+	rotation atomic.Uint32
 }
 
 // ServeDNS implements the middleware.Handler interface.
 func (p *unifinames) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	if !p.haveRoutine.Load() {
-		p.haveRoutine.Store(true)
-		go func() {
-			update := func() {
-				p.mu.Lock()
-				if p.Config.Debug {
-					log.Println("[unifi-names] updating clients")
-				}
-				if err := p.getClients(context.Background()); err != nil {
-					p.mu.Unlock()
-					log.Printf("[unifi-names] unable to get clients: %v\n", err)
-					return
-				}
-				p.mu.Unlock()
-				log.Printf("[unifi-names] got %d hosts", len(p.aClients)+len(p.aaaaClients))
-				p.lastUpdate = time.Now()
-			}
-			update()
-			t := time.NewTicker(time.Duration(p.Config.TTL) * time.Second)
-			for range t.C {
-				update()
-			}
-		}()
+	// only the first query starts the routines, concurrent queries must not start them again
+	if p.haveRoutine.CAS(false, true) {
+		for _, ctrl := range p.getControllers() {
+			go p.refreshRoutine(ctrl)
+		}
+	}
+	if len(r.Question) > 0 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		return p.serveTransfer(ctx, w, r)
 	}
 	if p.resolve(w, r) {
 		return dns.RcodeSuccess, nil
 	}
-	return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	return p.negative(ctx, w, r)
+}
+
+// refreshRoutine refreshes the clients of ctrl at the refresh rate until the plugin is closed,
+// if events are enabled it also keeps an event routine for every site running.
+func (p *unifinames) refreshRoutine(ctrl *controller) {
+	// the context stops the retries of a refresh when the plugin is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	update := func() {
+		if p.Config.Debug {
+			log.Printf("[unifi-names] updating clients of `%s'\n", ctrl.config.URL)
+		}
+		if err := p.getControllerClients(ctx, ctrl); err != nil {
+			log.Printf("[unifi-names] unable to get clients of `%s': %v\n", ctrl.config.URL, err)
+			return
+		}
+		p.mu.Lock()
+		var hosts int
+		for _, recs := range p.records {
+			hosts += len(recs.aClients) + len(recs.aaaaClients)
+		}
+		p.mu.Unlock()
+		log.Printf("[unifi-names] got %d hosts", hosts)
+		if ctrl.config.Events {
+			p.watchSites(ctrl)
+		}
+	}
+	update()
+	t := time.NewTicker(p.refreshInterval(ctrl.config))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			update()
+		case <-ctrl.refresh:
+			update()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// getControllers returns the controllers, they are created on the first call.
+func (p *unifinames) getControllers() []*controller {
+	p.once.Do(func() {
+		for i, cfg := range p.Config.Controllers {
+			unifi, err := newUnifiClient(cfg, p.Config.Debug)
+			if err != nil {
+				log.Printf("[unifi-names] unable to create client for `%s': %v\n", cfg.URL, err)
+				continue
+			}
+			p.controllers = append(p.controllers, &controller{
+				id:      i,
+				config:  cfg,
+				unifi:   unifi,
+				refresh: make(chan struct{}, 1),
+			})
+		}
+	})
+	return p.controllers
 }
 
 // Name implements the Handler interface.
 func (*unifinames) Name() string { return "unifi-names" }
 
+// close stops the refresh routines and logs out of the controllers.
+func (p *unifinames) close() error {
+	if p.done != nil {
+		close(p.done)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var lastErr error
+	for _, ctrl := range p.getControllers() {
+		if err := ctrl.unifi.close(ctx); err != nil {
+			log.Printf("[unifi-names] unable to close `%s': %v\n", ctrl.config.URL, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 func (p *unifinames) resolve(w dns.ResponseWriter, r *dns.Msg) bool {
 	if len(r.Question) <= 0 {
 		return false
@@ -87,27 +198,24 @@ func (p *unifinames) resolve(w dns.ResponseWriter, r *dns.Msg) bool {
 		}
 
 		switch question.Qtype {
-		case dns.TypeA:
+		case dns.TypeA, dns.TypeAAAA:
 			if p.shouldHandle(strings.ToLower(question.Name)) {
-				p.mu.Lock()
-				for _, client := range p.aClients {
-					if strings.EqualFold(client.Hdr.Name, question.Name) {
-						client.Hdr.Ttl = p.Config.TTL - uint32(time.Now().Sub(p.lastUpdate).Seconds())
-						rrs = append(rrs, &client)
-						break
-					}
-				}
-				p.mu.Unlock()
+				rrs = append(rrs, p.order(p.addresses(question.Name, question.Qtype))...)
 			}
-		case dns.TypeAAAA:
-			if p.shouldHandle(strings.ToLower(question.Name)) {
+		case dns.TypeSOA, dns.TypeNS:
+			name := strings.ToLower(question.Name)
+			if zone := p.zone(name); zone == name && p.available(zone) {
+				rrs = append(rrs, p.apex(zone, question.Qtype)...)
+			}
+		case dns.TypePTR:
+			if p.shouldHandleReverse(strings.ToLower(question.Name)) {
 				p.mu.Lock()
-				for _, client := range p.aaaaClients {
-					if strings.EqualFold(client.Hdr.Name, question.Name) {
-						client.Hdr.Ttl = p.Config.TTL - uint32(time.Now().Sub(p.lastUpdate).Seconds())
-						rrs = append(rrs, &client)
-						break
+				for _, recs := range p.records {
+					ttl, ok := p.ttl(recs)
+					if !ok {
+						continue
 					}
+					rrs = append(rrs, recs.ptr(question.Name, ttl)...)
 				}
 				p.mu.Unlock()
 			}
@@ -120,187 +228,421 @@ func (p *unifinames) resolve(w dns.ResponseWriter, r *dns.Msg) bool {
 		}
 		m := new(dns.Msg)
 		m.SetReply(r)
+		m.Authoritative = true
 		m.Answer = rrs
-		w.WriteMsg(m)
+		// udp answers that exceed the buffer of the client are truncated, so the client asks again over tcp
+		state := request.Request{W: w, Req: r}
+		state.SizeAndDo(m)
+		w.WriteMsg(state.Scrub(m))
 		return true
 	}
 	return false
 }
 
-func (p *unifinames) shouldHandle(name string) bool {
-	for _, domain := range p.Config.Networks {
-		if strings.HasSuffix(name, domain) {
-			return true
+// addresses returns the A or AAAA records of name of all sites, every address once.
+// The records of a set share the lowest ttl of the sites they are from (RFC 2181 5.2).
+func (p *unifinames) addresses(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	minTTL := ^uint32(0)
+	add := func(ip net.IP, rr dns.RR, ttl uint32) {
+		if ttl < minTTL {
+			minTTL = ttl
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			rrs = append(rrs, rr)
 		}
 	}
-	return false
-}
 
-var reSetCookieToken = regexp.MustCompile(`unifises=([0-9a-zA-Z]+)`)
-
-func (p *unifinames) getClients(ctx context.Context) error {
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return err
+	p.mu.Lock()
+	// the sites are visited in a fixed order, so the order of the answers only changes with the records
+	keys := make([]string, 0, len(p.records))
+	for key := range p.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		recs := p.records[key]
+		ttl, ok := p.ttl(recs)
+		if !ok {
+			continue
+		}
+		if qtype == dns.TypeA {
+			for i := range recs.aClients {
+				if strings.EqualFold(recs.aClients[i].Hdr.Name, name) {
+					client := recs.aClients[i]
+					add(client.A, &client, ttl)
+				}
+			}
+		} else {
+			for i := range recs.aaaaClients {
+				if strings.EqualFold(recs.aaaaClients[i].Hdr.Name, name) {
+					client := recs.aaaaClients[i]
+					add(client.AAAA, &client, ttl)
+				}
+			}
+		}
 	}
+	p.mu.Unlock()
 
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: len(p.Config.UnifiSSLFingerprint) > 0,
-				VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-					if p.Config.UnifiSSLFingerprint == nil {
-						return errors.New("should never happen")
-					}
-					if len(rawCerts) == 0 {
-						return errors.New("no certificate present")
-					}
-					hash := sha1.Sum(rawCerts[0])
-					if !bytes.Equal(hash[:], p.Config.UnifiSSLFingerprint) {
-						return fmt.Errorf("ssl fingerprint mismatch: expected %x got %x", p.Config.UnifiSSLFingerprint, hash)
-					}
-					return nil
-				},
-			},
-		},
-		Jar:     jar,
-		Timeout: time.Minute,
+	for _, rr := range rrs {
+		rr.Header().Ttl = minTTL
 	}
+	return rrs
+}
 
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(map[string]string{
-		"username": p.Config.UnifiUsername,
-		"password": p.Config.UnifiPassword,
-	}); err != nil {
-		return fmt.Errorf("unable to encode payload: %w", err)
+// order orders the records of a name as configured.
+func (p *unifinames) order(rrs []dns.RR) []dns.RR {
+	if len(rrs) < 2 {
+		return rrs
+	}
+	switch p.Config.Order {
+	case orderRoundRobin:
+		n := int(p.rotation.Inc() % uint32(len(rrs)))
+		return append(append([]dns.RR{}, rrs[n:]...), rrs[:n]...)
+	case orderShuffle:
+		rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
 	}
+	return rrs
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Config.UnifiControllerURL+"/api/login", &buf)
-	if err != nil {
-		return fmt.Errorf("unable to create login request: %w", err)
+// refreshInterval returns the refresh rate of the clients of a controller.
+func (p *unifinames) refreshInterval(cfg *controllerConfig) time.Duration {
+	if cfg.Refresh > 0 {
+		return cfg.Refresh
+	}
+	if p.Config.Refresh > 0 {
+		return p.Config.Refresh
 	}
+	return time.Duration(p.Config.TTL) * time.Second
+}
 
-	req.Header.Set("Referer", p.Config.UnifiControllerURL+"/login")
+// ttl returns the ttl of recs, fresh records are served with the TTL (but not below MinTTL).
+// Records whose refresh is overdue are stale, they are served with the stale ttl until they are older than
+// MaxStale (or the maximum age of the cache for restored records), after that ttl reports false.
+func (p *unifinames) ttl(recs *records) (uint32, bool) {
+	age := time.Since(recs.lastUpdate)
+	refresh := recs.refresh
+	if refresh <= 0 {
+		refresh = time.Duration(p.Config.TTL) * time.Second
+	}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("unable to perform login request: %w", err)
+	var ttl time.Duration
+	if age < refresh {
+		ttl = time.Duration(p.Config.TTL) * time.Second
+	} else if age < refresh+p.Config.MaxStale || (recs.restored && age < p.Config.CacheMaxAge) {
+		ttl = p.Config.StaleTTL
+	} else {
+		return 0, false
 	}
+	if ttl < p.Config.MinTTL {
+		ttl = p.Config.MinTTL
+	}
+	// round up, a fraction of a second is not lost
+	return uint32((ttl + time.Second - 1) / time.Second), true
+}
 
-	if res.Body != nil {
-		if err = res.Body.Close(); err != nil {
-			return fmt.Errorf("unable to close login body: %w", err)
+func (p *unifinames) shouldHandle(name string) bool {
+	for _, domain := range p.Config.domains() {
+		if strings.HasSuffix(name, domain) {
+			return true
 		}
 	}
-
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("login failed: expected status 200 got %d", res.StatusCode)
+	// domains that were discovered from the controllers
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, recs := range p.records {
+		for _, domain := range recs.domains {
+			if strings.HasSuffix(name, domain) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	matches := reSetCookieToken.FindStringSubmatch(res.Header.Get("Set-Cookie"))
-	if len(matches) != 2 {
-		return fmt.Errorf("login failed: invalid or no cookie")
+// shouldHandleReverse reports whether name is in a reverse zone PTR queries are answered in.
+func (p *unifinames) shouldHandleReverse(name string) bool {
+	zones := p.Config.ReverseZones
+	if len(zones) == 0 {
+		zones = []string{"in-addr.arpa.", "ip6.arpa."}
 	}
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
 
-	// get clients
-
-	req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.Config.UnifiControllerURL+"/api/s/"+p.Config.UnifiSite+"/stat/sta", nil)
-	if err != nil {
-		return fmt.Errorf("unable to create list clients request: %w", err)
+// ptr returns a PTR record with ttl for every name of the address whose reverse name is name.
+func (recs *records) ptr(name string, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	answer := func(target string, ip net.IP) {
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil || !strings.EqualFold(reverse, name) || seen[target] {
+			return
+		}
+		seen[target] = true
+		rrs = append(rrs, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ptr: target,
+		})
+	}
+	for _, rr := range recs.aClients {
+		answer(rr.Hdr.Name, rr.A)
+	}
+	for _, rr := range recs.aaaaClients {
+		answer(rr.Hdr.Name, rr.AAAA)
 	}
+	return rrs
+}
 
-	res, err = client.Do(req)
+// getControllerClients refreshes the records of every site of ctrl.
+// A site that fails keeps its previous records.
+func (p *unifinames) getControllerClients(ctx context.Context, ctrl *controller) error {
+	sites, err := p.siteConfigs(ctx, ctrl)
 	if err != nil {
-		return fmt.Errorf("unable to perform list clients request: %w", err)
+		return err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		if err = res.Body.Close(); err != nil {
-			return fmt.Errorf("unable to close logout body: %w", err)
+	var failed int
+	var lastErr error
+	fetched := make(map[string]*records, len(sites))
+	for site, sc := range sites {
+		recs, err := p.getSiteClients(ctx, ctrl, site, sc)
+		if err != nil {
+			log.Printf("[unifi-names] unable to get clients of site `%s': %v\n", site, err)
+			failed++
+			lastErr = err
+			continue
 		}
-		return fmt.Errorf("unable to list clients: expected status 200 got %d", res.StatusCode)
+		fetched[ctrl.key(site)] = recs
 	}
 
-	var data struct {
-		Data []struct {
-			Name    string
-			Network string
-			IP      string
+	p.mu.Lock()
+	if p.records == nil {
+		p.records = make(map[string]*records)
+	}
+	prefix := ctrl.key("")
+	for key := range p.records {
+		if !strings.HasPrefix(key, prefix) {
+			continue
 		}
+		if _, ok := sites[strings.TrimPrefix(key, prefix)]; !ok {
+			delete(p.records, key)
+		}
+	}
+	for key, recs := range fetched {
+		p.records[key] = recs
 	}
+	p.updateSerials()
+	p.mu.Unlock()
 
-	if err = json.NewDecoder(res.Body).Decode(&data); err != nil {
-		return fmt.Errorf("unable to decode list clients: %w", err)
+	if failed > 0 && failed == len(sites) {
+		return fmt.Errorf("unable to get clients of all %d sites: %w", failed, lastErr)
+	}
+	if err := p.saveCache(); err != nil {
+		log.Printf("[unifi-names] unable to write the cache file: %v\n", err)
 	}
+	return nil
+}
 
-	if res.Body != nil {
-		if err = res.Body.Close(); err != nil {
-			return fmt.Errorf("unable to close logout body: %w", err)
+// siteConfig describes how the records of a site are published.
+type siteConfig struct {
+	// networks maps the networks to their domain
+	networks map[string]string
+	// policies holds the ipv6 address selection by network
+	policies map[string]ipv6Policy
+	// devices is the domain of the unifi devices, if empty they are published in the domain of their network
+	devices string
+}
+
+// siteConfigs returns the configuration of every site of ctrl that should be served.
+func (p *unifinames) siteConfigs(ctx context.Context, ctrl *controller) (map[string]siteConfig, error) {
+	cfg := ctrl.config
+	sites := make(map[string]siteConfig, len(cfg.Sites)+1)
+	if cfg.AllSites {
+		var data []struct {
+			Name string
+			Desc string
+		}
+		if err := ctrl.unifi.get(ctx, "/api/self/sites", &data); err != nil {
+			return nil, fmt.Errorf("unable to list sites: %w", err)
 		}
+		for _, entry := range data {
+			label := sanitizeName(entry.Desc)
+			if label == "" {
+				label = sanitizeName(entry.Name)
+			}
+			if label == "" {
+				continue
+			}
+			sc := siteConfig{
+				networks: make(map[string]string, len(cfg.Networks)),
+				policies: cfg.IPv6Policies,
+			}
+			for network, domain := range cfg.Networks {
+				sc.networks[network] = label + "." + domain
+			}
+			if cfg.DevicesDomain != "" {
+				sc.devices = label + "." + cfg.DevicesDomain
+			}
+			sites[entry.Name] = sc
+		}
+	} else if len(cfg.Networks) > 0 || cfg.DevicesDomain != "" || cfg.AutoNetworks {
+		sites[cfg.Site] = siteConfig{networks: cfg.Networks, policies: cfg.IPv6Policies, devices: cfg.DevicesDomain}
+	}
+	for site, networks := range cfg.Sites {
+		sites[site] = siteConfig{networks: networks, policies: cfg.SiteIPv6Policies[site], devices: cfg.DevicesDomain}
 	}
+	return sites, nil
+}
 
-	req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.Config.UnifiControllerURL+"/logout", nil)
+// getSiteClients fetches the clients (and devices) of a site and maps them to dns records.
+func (p *unifinames) getSiteClients(ctx context.Context, ctrl *controller, site string, sc siteConfig) (*records, error) {
+	data, err := ctrl.getClients(ctx, site)
 	if err != nil {
-		return fmt.Errorf("unable to create logout request: %w", err)
+		return nil, err
 	}
 
-	res, err = client.Do(req)
-	if err != nil {
-		return fmt.Errorf("unable to perform logout request: %w", err)
+	var networks []network
+	if ctrl.config.AutoNetworks || (ctrl.config.Devices && sc.devices == "") {
+		if networks, err = ctrl.getNetworks(ctx, site); err != nil {
+			return nil, err
+		}
+	}
+	if ctrl.config.AutoNetworks {
+		sc.networks = discoverDomains(networks, sc.networks)
 	}
 
-	if res.Body != nil {
-		if err = res.Body.Close(); err != nil {
-			return fmt.Errorf("unable to close logout body: %w", err)
+	var devices []device
+	if ctrl.config.Devices {
+		if devices, err = ctrl.getDevices(ctx, site); err != nil {
+			return nil, err
 		}
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unable to logout: expected status 200 got %d", res.StatusCode)
+	recs := records{
+		lastUpdate: time.Now(),
+		refresh:    p.refreshInterval(ctrl.config),
+		config:     sc,
+		clients:    data,
+		devices:    devices,
+		networks:   networks,
 	}
+	recs.build()
+	return &recs, nil
+}
 
-	p.aClients = nil
-	p.aaaaClients = nil
+// build creates the dns records from the sources.
+func (recs *records) build() {
+	recs.aClients, recs.aaaaClients, recs.domains = nil, nil, nil
+	for _, domain := range recs.config.networks {
+		recs.addDomain(domain)
+	}
+	recs.addDomain(recs.config.devices)
 
-	for _, entry := range data.Data {
-		entry.Name = sanitizeName(entry.Name)
-		if entry.Name == "" {
+	for _, entry := range recs.clients {
+		domain, ok := recs.config.networks[strings.ToLower(entry.Network)]
+		if !ok {
 			continue
 		}
-		ip := net.ParseIP(entry.IP)
-		if ip == nil {
-			continue
+		for _, address := range entry.addresses(recs.config.policies[strings.ToLower(entry.Network)]) {
+			recs.add(entry.Name, domain, address)
 		}
+	}
 
-		domain, ok := p.Config.Networks[strings.ToLower(entry.Network)]
-		if !ok {
-			continue
+	for _, entry := range recs.devices {
+		domain := recs.config.devices
+		if domain == "" {
+			var ok bool
+			if domain, ok = recs.config.networks[strings.ToLower(networkOf(recs.networks, entry.IP))]; !ok {
+				continue
+			}
 		}
+		recs.add(entry.Name, domain, entry.IP)
+	}
+}
 
-		hdr := dns.RR_Header{
-			Name:     entry.Name + "." + domain,
-			Rrtype:   0,
-			Class:    dns.ClassINET,
-			Ttl:      0,
-			Rdlength: 0,
+// discoverDomains maps every network that has a domain name set in the controller to that domain,
+// the explicit mapping takes precedence.
+func discoverDomains(networks []network, explicit map[string]string) map[string]string {
+	mapping := make(map[string]string, len(networks)+len(explicit))
+	for _, entry := range networks {
+		if entry.DomainName == "" {
+			continue
 		}
+		domain, err := parseDomain(entry.DomainName)
+		if err != nil {
+			log.Printf("[unifi-names] ignoring domain of network `%s': %v\n", entry.Name, err)
+			continue
+		}
+		mapping[strings.ToLower(entry.Name)] = domain
+	}
+	for network, domain := range explicit {
+		mapping[network] = domain
+	}
+	return mapping
+}
 
-		if ip.To4() != nil {
-			hdr.Rrtype = dns.TypeA
-			p.aClients = append(p.aClients, dns.A{
-				Hdr: hdr,
-				A:   ip,
-			})
-		} else {
-			hdr.Rrtype = dns.TypeAAAA
-			p.aaaaClients = append(p.aaaaClients, dns.AAAA{
-				Hdr:  hdr,
-				AAAA: ip,
-			})
+// addDomain adds domain to the domains of the records.
+func (recs *records) addDomain(domain string) {
+	if domain == "" {
+		return
+	}
+	for _, d := range recs.domains {
+		if d == domain {
+			return
 		}
 	}
+	recs.domains = append(recs.domains, domain)
+}
 
-	return nil
+// add adds a record for name in domain, names and ips that are not valid are skipped.
+func (recs *records) add(name, domain, address string) {
+	name = sanitizeName(name)
+	if name == "" {
+		return
+	}
+	recs.addAddress(name+"."+domain, address)
+}
+
+// addAddress adds a record for the fully qualified name, ips that are not valid are skipped.
+func (recs *records) addAddress(name, address string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return
+	}
+
+	hdr := dns.RR_Header{
+		Name:     name,
+		Rrtype:   0,
+		Class:    dns.ClassINET,
+		Ttl:      0,
+		Rdlength: 0,
+	}
+
+	if ip.To4() != nil {
+		hdr.Rrtype = dns.TypeA
+		recs.aClients = append(recs.aClients, dns.A{
+			Hdr: hdr,
+			A:   ip,
+		})
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		recs.aaaaClients = append(recs.aaaaClients, dns.AAAA{
+			Hdr:  hdr,
+			AAAA: ip,
+		})
+	}
 }
 
 func isAllowedRune(allowedRunes []rune, r rune) bool {
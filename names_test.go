@@ -2,20 +2,34 @@ package unifinames
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 
 	"net/http"
 	"net/http/httptest"
+	"strings"
 
 	"fmt"
 
 	"crypto/sha1"
+	"crypto/x509"
 
 	"time"
 
+	"github.com/coredns/coredns/plugin/transfer"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"golang.org/x/net/websocket"
 )
 
 type dummyResponseWriter struct {
@@ -46,20 +60,269 @@ func (d *dummyResponseWriter) ClearMsgs()          { d.msgs = nil }
 func (d *dummyResponseWriter) GetBytes() []byte { return d.bytes }
 func (d *dummyResponseWriter) ClearBytes()      { d.bytes = nil }
 
-func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Server {
+type mockClient struct {
+	Network string
+	Name    string
+	IP      string
+	// Offline clients are only listed in the client history
+	Offline bool
+	// LastSeen defaults to now
+	LastSeen time.Time
+	// FixedIP is the dhcp reservation of the client
+	FixedIP string
+	// Device is set for unifi devices, they are only listed in the device list
+	Device bool
+	// IPv6 are the ipv6 addresses of a dual-stack client
+	IPv6 []string
+}
+
+type mockController struct {
+	*httptest.Server
+	logins   atomic.Int32
+	logouts  atomic.Int32
+	session  atomic.String
+	failSite atomic.String
+	// totpCode is the one-time code that is required on login, if set
+	totpCode atomic.String
+	// events are pushed to the event streams, an empty event closes the stream
+	events  chan string
+	streams atomic.Int32
+}
+
+// expireSessions invalidates the current session, so the next request requires a new login.
+func (m *mockController) expireSessions() { m.session.Store("") }
+
+func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *mockController {
+	return mockUnifiController(fingerprint, false, map[string][]mockClient{
+		"default": {{Network: lan, Name: name, IP: ip}},
+	})
+}
+
+func MockUnifiOSController(fingerprint *[]byte, lan, name, ip string) *mockController {
+	return mockUnifiController(fingerprint, true, map[string][]mockClient{
+		"default": {{Network: lan, Name: name, IP: ip}},
+	})
+}
+
+func mockUnifiController(fingerprint *[]byte, unifiOS bool, sites map[string][]mockClient) *mockController {
+	const csrfToken = "cafebabe"
+	const apiKey = "secretkey"
+	m := mockController{
+		events: make(chan string, 16),
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Set-Cookie", "unifises=deadbeef")
+	checkCredentials := func(w http.ResponseWriter, r *http.Request) bool {
+		var credentials struct {
+			Username   string
+			Password   string
+			Token      string
+			LegacyCode string `json:"ubic_2fa_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil || credentials.Username != "admin" || credentials.Password != "admin" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		code := credentials.LegacyCode
+		if unifiOS {
+			code = credentials.Token
+		}
+		if expected := m.totpCode.Load(); expected != "" && code != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		m.logins.Inc()
+		m.session.Store(fmt.Sprintf("deadbeef%d", m.logins.Load()))
+		return true
+	}
+	cookieName := "unifises"
+	apiPrefix := ""
+	if unifiOS {
+		cookieName = "TOKEN"
+		apiPrefix = "/proxy/network"
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		mux.HandleFunc("/api/auth/login", func(w http.ResponseWriter, r *http.Request) {
+			if !checkCredentials(w, r) {
+				return
+			}
+			w.Header().Set("Set-Cookie", "TOKEN="+m.session.Load()+"; Path=/")
+			w.Header().Set("X-CSRF-Token", csrfToken)
+			w.WriteHeader(http.StatusOK)
+		})
+		mux.HandleFunc("/api/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+			m.logouts.Inc()
+			w.WriteHeader(http.StatusOK)
+		})
+	} else {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.Redirect(w, r, "/manage", http.StatusFound)
+		})
+		mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+			if !checkCredentials(w, r) {
+				return
+			}
+			w.Header().Set("Set-Cookie", "unifises="+m.session.Load()+"; Path=/")
+			w.WriteHeader(http.StatusOK)
+		})
+		mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+			m.logouts.Inc()
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if key := r.Header.Get("X-API-KEY"); key != "" {
+			if key != apiKey {
+				w.WriteHeader(http.StatusUnauthorized)
+				return false
+			}
+			return true
+		}
+		if unifiOS && r.Header.Get("X-CSRF-Token") != csrfToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		if cookie, err := r.Cookie(cookieName); err != nil || cookie.Value == "" || cookie.Value != m.session.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"data":[],"meta":{"msg":"api.err.LoginRequired","rc":"error"}}`)
+			return false
+		}
+		return true
+	}
+	mux.HandleFunc(apiPrefix+"/api/self/sites", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		var data []string
+		for site := range sites {
+			data = append(data, fmt.Sprintf(`{"_id":"eeeeeeeeeeeeeeeeeeeeeeee","desc":"%s","name":"%s","role":"admin"}`, strings.ToUpper(site[:1])+site[1:], site))
+		}
 		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"data":[%s],"meta":{"rc":"ok"}}`, strings.Join(data, ","))
 	})
-	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(apiPrefix+"/api/s/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, apiPrefix+"/api/s/"), "/", 2)
+		clients, ok := sites[parts[0]]
+		if !ok || parts[0] == m.failSite.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"data":[],"meta":{"msg":"api.err.NoSiteContext","rc":"error"}}`)
+			return
+		}
+		var data []string
+		switch {
+		case len(parts) == 2 && parts[1] == "stat/sta":
+			for i, client := range clients {
+				if client.Offline || client.Device {
+					continue
+				}
+				ipv6, _ := json.Marshal(client.IPv6)
+				data = append(data, fmt.Sprintf(mockStation, client.IP, ipv6, mockMAC(i), client.Name, client.Network))
+			}
+		case len(parts) == 2 && parts[1] == "rest/user":
+			for i, client := range clients {
+				if client.Device {
+					continue
+				}
+				lastSeen := client.LastSeen
+				if lastSeen.IsZero() {
+					lastSeen = time.Now()
+				}
+				networkName := client.Network
+				if client.FixedIP != "" {
+					// reserved clients are looked up by their network id
+					networkName = ""
+				}
+				data = append(data, fmt.Sprintf(`{"_id":"eeeeeeeeeeeeeeeeeeeeeeee","mac":"%s","name":"%s","last_ip":"%s","last_seen":%d,"last_connection_network_name":"%s","network_id":"net-%s","use_fixedip":%t,"fixed_ip":"%s"}`,
+					mockMAC(i), client.Name, client.IP, lastSeen.Unix(), networkName, client.Network, client.FixedIP != "", client.FixedIP))
+			}
+		case len(parts) == 2 && parts[1] == "rest/networkconf":
+			networks := map[string]struct{}{}
+			for _, client := range clients {
+				if _, ok := networks[client.Network]; ok || client.Device {
+					continue
+				}
+				networks[client.Network] = struct{}{}
+				subnet := ""
+				if ip := net.ParseIP(client.IP).To4(); ip != nil {
+					subnet = fmt.Sprintf("%d.%d.%d.1/24", ip[0], ip[1], ip[2])
+				}
+				data = append(data, fmt.Sprintf(`{"_id":"net-%s","name":"%s","purpose":"corporate","ip_subnet":"%s","domain_name":"%s.home.arpa"}`, client.Network, client.Network, subnet, strings.ToLower(client.Network)))
+			}
+		case len(parts) == 2 && parts[1] == "stat/device":
+			for i, client := range clients {
+				if !client.Device {
+					continue
+				}
+				data = append(data, fmt.Sprintf(`{"_id":"eeeeeeeeeeeeeeeeeeeeeeee","adopted":true,"mac":"%s","name":"%s","ip":"%s","type":"usw","model":"US8P60"}`, mockMAC(i), client.Name, client.IP))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"data":[%s],"meta":{"rc":"ok"}}`, strings.Join(data, ","))
 	})
-	mux.HandleFunc("/api/s/default/stat/sta", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{
-  "data": [
-    {
+
+	mux.HandleFunc(apiPrefix+"/wss/s/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		websocket.Handler(func(ws *websocket.Conn) {
+			m.streams.Inc()
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var buf []byte
+				for websocket.Message.Receive(ws, &buf) == nil {
+				}
+			}()
+			for {
+				select {
+				case event := <-m.events:
+					if event == "" {
+						ws.Close()
+						return
+					}
+					if err := websocket.Message.Send(ws, event); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		}).ServeHTTP(w, r)
+	})
+
+	s := httptest.NewTLSServer(mux)
+	if len(s.TLS.Certificates) != 1 {
+		panic("expected 1 certificate")
+	}
+	if len(s.TLS.Certificates[0].Certificate) != 1 {
+		panic("expected 1 certificate")
+	}
+	if fingerprint != nil {
+		hash := sha1.Sum(s.TLS.Certificates[0].Certificate[0])
+		*fingerprint = hash[:]
+	}
+
+	m.Server = s
+	return &m
+}
+
+func mockMAC(i int) string { return fmt.Sprintf("aa:bb:cc:dd:ee:%02x", i) }
+
+const mockStation = `{
       "_id": "eeeeeeeeeeeeeeeeeeeeeeee",
       "_is_guest_by_uap": false,
       "_is_guest_by_ugw": false,
@@ -82,12 +345,13 @@ func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Se
       "hostname": "debian",
       "idletime": 16,
       "ip": "%s",
+      "ipv6_addresses": %s,
       "is_11r": false,
       "is_guest": false,
       "is_wired": false,
       "last_seen": 1597826986,
       "latest_assoc_time": 1597826893,
-      "mac": "aa:bb:cc:dd:ee:ff",
+      "mac": "%s",
       "name": "%s",
       "network": "%s",
       "network_id": "eeeeeeeeeeeeeeeeeeeeeeee",
@@ -118,27 +382,35 @@ func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Se
       "usergroup_id": "",
       "vlan": 0,
       "wifi_tx_attempts": 25915
-    }
-  ],
-  "meta": {
-    "rc": "ok"
-  }
-}`, ip, name, lan)
-	})
+    }`
 
-	s := httptest.NewTLSServer(mux)
-	if len(s.TLS.Certificates) != 1 {
-		panic("expected 1 certificate")
-	}
-	if len(s.TLS.Certificates[0].Certificate) != 1 {
-		panic("expected 1 certificate")
-	}
-	if fingerprint != nil {
-		hash := sha1.Sum(s.TLS.Certificates[0].Certificate[0])
-		*fingerprint = hash[:]
+// refresh refreshes the records of every controller of p, like the refresh routine does.
+func refresh(ctx context.Context, p *unifinames) error {
+	var lastErr error
+	for _, ctrl := range p.getControllers() {
+		if err := p.getControllerClients(ctx, ctrl); err != nil {
+			lastErr = err
+		}
 	}
+	return lastErr
+}
 
-	return s
+// lookup resolves name without starting the refresh routine.
+func lookup(p *unifinames, name string, qtype uint16) []dns.RR {
+	d := &dummyResponseWriter{}
+	p.resolve(d, &dns.Msg{
+		Question: []dns.Question{
+			{
+				Name:   name,
+				Qclass: dns.ClassINET,
+				Qtype:  qtype,
+			},
+		},
+	})
+	if len(d.GetMsgs()) == 0 {
+		return nil
+	}
+	return d.GetMsgs()[0].Answer
 }
 
 func TestServeDNS(t *testing.T) {
@@ -148,16 +420,18 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: fp,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -187,16 +461,18 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: fp,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -220,22 +496,141 @@ func TestServeDNS(t *testing.T) {
 		require.Equal(t, uint32(3600), d.GetMsgs()[0].Answer[0].Header().Ttl)
 	})
 
+	t.Run("UniFi OS", func(t *testing.T) {
+		for _, unifiType := range []string{controllerAuto, controllerUnifiOS} {
+			t.Run(unifiType, func(t *testing.T) {
+				var fp []byte
+				s := MockUnifiOSController(&fp, "lan", "server1", "127.0.0.1")
+				defer s.Close()
+				p := unifinames{
+					Config: &config{
+						TTL:   60 * 60,
+						Debug: true,
+						Controllers: []*controllerConfig{{
+							Networks: map[string]string{
+								"lan": "lan.",
+							},
+							URL:            s.URL,
+							Site:           "default",
+							Username:       "admin",
+							Password:       "admin",
+							SSLFingerprint: fp,
+							Type:           unifiType,
+						}},
+					},
+				}
+				d := &dummyResponseWriter{}
+				p.ServeDNS(context.Background(), &dummyResponseWriter{}, &dns.Msg{})
+				time.Sleep(time.Millisecond * 500)
+				p.ServeDNS(context.Background(), d, &dns.Msg{
+					Question: []dns.Question{
+						{
+							Name:   "server1.lan.",
+							Qclass: dns.ClassINET,
+							Qtype:  dns.TypeA,
+						},
+					},
+				})
+				require.Equal(t, 1, len(d.GetMsgs()))
+				require.Equal(t, 1, len(d.GetMsgs()[0].Answer))
+				require.Equal(t, "server1.lan.", d.GetMsgs()[0].Answer[0].Header().Name)
+				require.Equal(t, net.ParseIP("127.0.0.1"), d.GetMsgs()[0].Answer[0].(*dns.A).A)
+			})
+		}
+	})
+
+	t.Run("Wrong Controller Type", func(t *testing.T) {
+		var fp []byte
+		s := MockUnifiOSController(&fp, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+					Type:           controllerLegacy,
+				}},
+			},
+		}
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), &dummyResponseWriter{}, &dns.Msg{})
+		time.Sleep(time.Millisecond * 500)
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{
+				{
+					Name:   "server1.lan.",
+					Qclass: dns.ClassINET,
+					Qtype:  dns.TypeA,
+				},
+			},
+		})
+		require.Equal(t, 0, len(d.GetMsgs()))
+	})
+
+	t.Run("API Key", func(t *testing.T) {
+		for apiKey, answers := range map[string]int{"secretkey": 1, "wrongkey": 0} {
+			t.Run(apiKey, func(t *testing.T) {
+				var fp []byte
+				s := MockUnifiOSController(&fp, "lan", "server1", "127.0.0.1")
+				defer s.Close()
+				p := unifinames{
+					Config: &config{
+						TTL:   60 * 60,
+						Debug: true,
+						Controllers: []*controllerConfig{{
+							Networks: map[string]string{
+								"lan": "lan.",
+							},
+							URL:            s.URL,
+							Site:           "default",
+							APIKey:         apiKey,
+							SSLFingerprint: fp,
+						}},
+					},
+				}
+				d := &dummyResponseWriter{}
+				p.ServeDNS(context.Background(), &dummyResponseWriter{}, &dns.Msg{})
+				time.Sleep(time.Millisecond * 500)
+				p.ServeDNS(context.Background(), d, &dns.Msg{
+					Question: []dns.Question{
+						{
+							Name:   "server1.lan.",
+							Qclass: dns.ClassINET,
+							Qtype:  dns.TypeA,
+						},
+					},
+				})
+				require.Equal(t, answers, len(d.GetMsgs()))
+			})
+		}
+	})
+
 	t.Run("Unknown Client", func(t *testing.T) {
 		var fp []byte
 		s := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: fp,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -250,6 +645,24 @@ func TestServeDNS(t *testing.T) {
 				},
 			},
 		})
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeNameError, d.GetMsgs()[0].Rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 1, len(d.GetMsgs()[0].Ns))
+		require.Equal(t, dns.TypeSOA, d.GetMsgs()[0].Ns[0].Header().Rrtype)
+
+		// with fallthrough the query is passed to the next plugin
+		d.ClearMsgs()
+		p.Config.Fall.SetZonesFromArgs(nil)
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{
+				{
+					Name:   "server2.lan.",
+					Qclass: dns.ClassINET,
+					Qtype:  dns.TypeA,
+				},
+			},
+		})
 		require.Equal(t, 0, len(d.GetMsgs()))
 	})
 
@@ -259,16 +672,18 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: fp,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -284,16 +699,18 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: fp,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -320,16 +737,18 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: fp,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -352,16 +771,18 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
-				},
-				TTL:                 60 * 60,
-				Debug:               true,
-				UnifiControllerURL:  s.URL,
-				UnifiSite:           "default",
-				UnifiUsername:       "admin",
-				UnifiPassword:       "admin",
-				UnifiSSLFingerprint: nil,
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: nil,
+				}},
 			},
 		}
 		d := &dummyResponseWriter{}
@@ -378,4 +799,1596 @@ func TestServeDNS(t *testing.T) {
 		})
 		require.Equal(t, 0, len(d.GetMsgs()))
 	})
+
+	t.Run("Session", func(t *testing.T) {
+		for _, unifiOS := range []bool{false, true} {
+			t.Run(fmt.Sprintf("UniFi OS %t", unifiOS), func(t *testing.T) {
+				var fp []byte
+				s := mockUnifiController(&fp, unifiOS, map[string][]mockClient{
+					"default": {{Network: "lan", Name: "server1", IP: "127.0.0.1"}},
+				})
+				defer s.Close()
+				p := unifinames{
+					Config: &config{
+						TTL:   60 * 60,
+						Debug: true,
+						Controllers: []*controllerConfig{{
+							Networks: map[string]string{
+								"lan": "lan.",
+							},
+							URL:            s.URL,
+							Site:           "default",
+							Username:       "admin",
+							Password:       "admin",
+							SSLFingerprint: fp,
+						}},
+					},
+				}
+				require.NoError(t, refresh(context.Background(), &p))
+				require.NoError(t, refresh(context.Background(), &p))
+				require.Equal(t, int32(1), s.logins.Load())
+				require.Equal(t, int32(0), s.logouts.Load())
+				require.Equal(t, 1, len(p.records["0/default"].aClients))
+
+				// login again after the session expired
+				s.expireSessions()
+				require.NoError(t, refresh(context.Background(), &p))
+				require.Equal(t, int32(2), s.logins.Load())
+				require.Equal(t, 1, len(p.records["0/default"].aClients))
+
+				require.NoError(t, p.close())
+				require.Equal(t, int32(1), s.logouts.Load())
+			})
+		}
+	})
+
+	t.Run("Sites", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {{Network: "lan", Name: "server1", IP: "127.0.0.1"}},
+			"office":  {{Network: "lan", Name: "server2", IP: "127.0.0.2"}},
+			"lab":     {{Network: "lan", Name: "server3", IP: "127.0.0.3"}},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					Sites: map[string]map[string]string{
+						"office": {"lan": "office."},
+						"lab":    {"lan": "lab."},
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server2.office.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server3.lab.", dns.TypeA)))
+		require.Equal(t, 0, len(lookup(&p, "server2.lan.", dns.TypeA)))
+
+		// a failing site keeps its records, the others are refreshed
+		s.failSite.Store("office")
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server2.office.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server3.lab.", dns.TypeA)))
+	})
+
+	t.Run("All Sites", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, true, map[string][]mockClient{
+			"default": {{Network: "lan", Name: "server1", IP: "127.0.0.1"}},
+			"office":  {{Network: "lan", Name: "server2", IP: "127.0.0.2"}},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					AllSites:       true,
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.default.lan.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server2.office.lan.", dns.TypeA)))
+		require.Equal(t, 0, len(lookup(&p, "server1.lan.", dns.TypeA)))
+	})
+
+	t.Run("Multiple Controllers", func(t *testing.T) {
+		var fp1, fp2 []byte
+		s1 := MockUnifiController(&fp1, "lan", "server1", "127.0.0.1")
+		defer s1.Close()
+		s2 := MockUnifiOSController(&fp2, "lan", "server2", "127.0.0.2")
+		defer s2.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{
+					{
+						Networks:       map[string]string{"lan": "building1."},
+						URL:            s1.URL,
+						Site:           "default",
+						Username:       "admin",
+						Password:       "admin",
+						SSLFingerprint: fp1,
+					},
+					{
+						Networks:       map[string]string{"lan": "building2."},
+						URL:            s2.URL,
+						Site:           "default",
+						Username:       "admin",
+						Password:       "admin",
+						SSLFingerprint: fp2,
+					},
+				},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.building1.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server2.building2.", dns.TypeA)))
+		require.Equal(t, 0, len(lookup(&p, "server2.building1.", dns.TypeA)))
+
+		// a failing controller does not affect the other one
+		s2.Close()
+		require.Error(t, refresh(context.Background(), &p))
+		require.NoError(t, p.getControllerClients(context.Background(), p.getControllers()[0]))
+		require.Equal(t, 1, len(lookup(&p, "server1.building1.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(&p, "server2.building2.", dns.TypeA)))
+	})
+
+	t.Run("Failover", func(t *testing.T) {
+		var primaryRequests atomic.Int32
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			primaryRequests.Inc()
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer primary.Close()
+		var fp []byte
+		standby := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
+		defer standby.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            primary.URL,
+					FailoverURLs:   []string{standby.URL},
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, int32(1), primaryRequests.Load())
+		require.Equal(t, 1, p.getControllers()[0].unifi.active)
+
+		// stick to the working endpoint
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(1), primaryRequests.Load())
+		require.Equal(t, int32(1), standby.logins.Load())
+
+		// switch back when the standby fails
+		standby.Close()
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(2), primaryRequests.Load())
+		require.Equal(t, 0, p.getControllers()[0].unifi.active)
+	})
+
+	t.Run("History", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1"},
+				{Network: "lan", Name: "nas", IP: "127.0.0.2", Offline: true, LastSeen: time.Now().Add(-time.Hour)},
+				{Network: "lan", Name: "laptop", IP: "127.0.0.3", Offline: true, LastSeen: time.Now().Add(-48 * time.Hour)},
+			},
+		})
+		defer s.Close()
+		newPlugin := func(retention time.Duration) *unifinames {
+			return &unifinames{
+				Config: &config{
+					TTL:   60 * 60,
+					Debug: true,
+					Controllers: []*controllerConfig{{
+						Networks: map[string]string{
+							"lan": "lan.",
+						},
+						URL:              s.URL,
+						Site:             "default",
+						Username:         "admin",
+						Password:         "admin",
+						SSLFingerprint:   fp,
+						HistoryRetention: retention,
+					}},
+				},
+			}
+		}
+
+		p := newPlugin(0)
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 0, len(lookup(p, "nas.lan.", dns.TypeA)))
+		require.Equal(t, 0, len(lookup(p, "laptop.lan.", dns.TypeA)))
+
+		p = newPlugin(24 * time.Hour)
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(p, "nas.lan.", dns.TypeA)))
+		require.Equal(t, net.ParseIP("127.0.0.2"), lookup(p, "nas.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, 0, len(lookup(p, "laptop.lan.", dns.TypeA)))
+	})
+
+	t.Run("Reservations", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1"},
+				{Network: "lan", Name: "server2", IP: "127.0.0.2", FixedIP: "127.0.0.20"},
+				{Network: "lan", Name: "server3", IP: "127.0.0.3", FixedIP: "127.0.0.30", Offline: true, LastSeen: time.Now().Add(-24 * 365 * time.Hour)},
+			},
+		})
+		defer s.Close()
+		newPlugin := func(reservations, preferObserved bool) *unifinames {
+			return &unifinames{
+				Config: &config{
+					TTL:   60 * 60,
+					Debug: true,
+					Controllers: []*controllerConfig{{
+						Networks: map[string]string{
+							"lan": "lan.",
+						},
+						URL:              s.URL,
+						Site:             "default",
+						Username:         "admin",
+						Password:         "admin",
+						SSLFingerprint:   fp,
+						Reservations:     reservations,
+						PreferObservedIP: preferObserved,
+					}},
+				},
+			}
+		}
+
+		p := newPlugin(false, false)
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, net.ParseIP("127.0.0.2"), lookup(p, "server2.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, 0, len(lookup(p, "server3.lan.", dns.TypeA)))
+
+		p = newPlugin(true, false)
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, net.ParseIP("127.0.0.1"), lookup(p, "server1.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, net.ParseIP("127.0.0.20"), lookup(p, "server2.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, net.ParseIP("127.0.0.30"), lookup(p, "server3.lan.", dns.TypeA)[0].(*dns.A).A)
+
+		p = newPlugin(true, true)
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, net.ParseIP("127.0.0.2"), lookup(p, "server2.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, net.ParseIP("127.0.0.30"), lookup(p, "server3.lan.", dns.TypeA)[0].(*dns.A).A)
+	})
+
+	t.Run("Devices", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1"},
+				{Name: "Switch Core", IP: "127.0.0.2", Device: true},
+				{Name: "AP Attic", IP: "127.0.1.2", Device: true},
+			},
+		})
+		defer s.Close()
+		newPlugin := func(devices bool, domain string) *unifinames {
+			return &unifinames{
+				Config: &config{
+					TTL:   60 * 60,
+					Debug: true,
+					Controllers: []*controllerConfig{{
+						Networks: map[string]string{
+							"lan": "lan.",
+						},
+						URL:            s.URL,
+						Site:           "default",
+						Username:       "admin",
+						Password:       "admin",
+						SSLFingerprint: fp,
+						Devices:        devices,
+						DevicesDomain:  domain,
+					}},
+				},
+			}
+		}
+
+		p := newPlugin(false, "")
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, 0, len(lookup(p, "switch-core.lan.", dns.TypeA)))
+
+		// mapped by their network
+		p = newPlugin(true, "")
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, net.ParseIP("127.0.0.2"), lookup(p, "switch-core.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, 0, len(lookup(p, "ap-attic.lan.", dns.TypeA)))
+
+		// dedicated domain
+		p = newPlugin(true, "infra.")
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 0, len(lookup(p, "switch-core.lan.", dns.TypeA)))
+		require.Equal(t, net.ParseIP("127.0.0.2"), lookup(p, "switch-core.infra.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, net.ParseIP("127.0.1.2"), lookup(p, "ap-attic.infra.", dns.TypeA)[0].(*dns.A).A)
+	})
+
+	t.Run("AutoNetworks", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "LAN", Name: "server1", IP: "127.0.0.1"},
+				{Network: "IoT", Name: "plug1", IP: "127.0.1.1"},
+			},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+					AutoNetworks:   true,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+
+		// the explicit mapping wins
+		require.Equal(t, net.ParseIP("127.0.0.1"), lookup(&p, "server1.lan.", dns.TypeA)[0].(*dns.A).A)
+		require.Equal(t, 0, len(lookup(&p, "server1.lan.home.arpa.", dns.TypeA)))
+		require.Equal(t, net.ParseIP("127.0.1.1"), lookup(&p, "plug1.iot.home.arpa.", dns.TypeA)[0].(*dns.A).A)
+		require.True(t, p.shouldHandle("plug1.iot.home.arpa."))
+		require.False(t, p.shouldHandle("plug1.iot.example.com."))
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		eventsMinBackoff = 10 * time.Millisecond
+		defer func() { eventsMinBackoff = time.Second }()
+
+		var fp []byte
+		s := mockUnifiController(&fp, true, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1"},
+				{Network: "lan", Name: "server2", IP: "127.0.0.2"},
+			},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+					Events:         true,
+				}},
+			},
+			done: make(chan struct{}),
+		}
+		defer p.close()
+		require.NoError(t, refresh(context.Background(), &p))
+		p.watchSites(p.getControllers()[0])
+		require.Eventually(t, func() bool { return s.streams.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+		resolves := func(name, ip string) func() bool {
+			return func() bool {
+				rrs := lookup(&p, name, dns.TypeA)
+				return len(rrs) == 1 && rrs[0].(*dns.A).A.Equal(net.ParseIP(ip))
+			}
+		}
+
+		// connect and ip change
+		s.events <- `{"meta":{"rc":"ok","message":"sta:sync"},"data":[` +
+			`{"mac":"aa:bb:cc:dd:ee:10","name":"phone1","network":"lan","ip":"127.0.0.10"},` +
+			`{"mac":"aa:bb:cc:dd:ee:00","ip":"127.0.0.100"}]}`
+		require.Eventually(t, resolves("phone1.lan.", "127.0.0.10"), time.Second, 10*time.Millisecond)
+		require.Eventually(t, resolves("server1.lan.", "127.0.0.100"), time.Second, 10*time.Millisecond)
+
+		// rename
+		s.events <- `{"meta":{"rc":"ok","message":"user:sync"},"data":[{"mac":"aa:bb:cc:dd:ee:10","name":"phone2"}]}`
+		require.Eventually(t, resolves("phone2.lan.", "127.0.0.10"), time.Second, 10*time.Millisecond)
+		require.Equal(t, 0, len(lookup(&p, "phone1.lan.", dns.TypeA)))
+
+		// disconnect
+		s.events <- `{"meta":{"rc":"ok","message":"events"},"data":[{"key":"EVT_WU_Disconnected","user":"aa:bb:cc:dd:ee:01"}]}`
+		require.Eventually(t, func() bool { return len(lookup(&p, "server2.lan.", dns.TypeA)) == 0 }, time.Second, 10*time.Millisecond)
+
+		// the stream is reopened when it drops
+		s.events <- ""
+		require.Eventually(t, func() bool { return s.streams.Load() == 2 }, time.Second, 10*time.Millisecond)
+		s.events <- `{"meta":{"rc":"ok","message":"sta:sync"},"data":[{"mac":"aa:bb:cc:dd:ee:10","ip":"127.0.0.11"}]}`
+		require.Eventually(t, resolves("phone2.lan.", "127.0.0.11"), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("IPv6 Addresses", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1", IPv6: []string{"2001:db8::1", "fe80::1", "2001:db8::2"}},
+				{Network: "lan", Name: "server2", IP: "2001:db8::10", IPv6: []string{"2001:db8::10", "fd00::10"}},
+				{Network: "lan", Name: "server3", IP: "fe80::3", IPv6: []string{"2001:db8::3"}},
+			},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+
+		rrs := lookup(&p, "server1.lan.", dns.TypeA)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, net.ParseIP("127.0.0.1"), rrs[0].(*dns.A).A)
+
+		// link-local addresses are skipped
+		rrs = lookup(&p, "server1.lan.", dns.TypeAAAA)
+		require.Equal(t, 2, len(rrs))
+		require.Equal(t, net.ParseIP("2001:db8::1"), rrs[0].(*dns.AAAA).AAAA)
+		require.Equal(t, net.ParseIP("2001:db8::2"), rrs[1].(*dns.AAAA).AAAA)
+
+		// duplicates are skipped
+		rrs = lookup(&p, "server2.lan.", dns.TypeAAAA)
+		require.Equal(t, 2, len(rrs))
+		require.Equal(t, net.ParseIP("2001:db8::10"), rrs[0].(*dns.AAAA).AAAA)
+		require.Equal(t, net.ParseIP("fd00::10"), rrs[1].(*dns.AAAA).AAAA)
+
+		// also if the link-local address is the ip of the client
+		rrs = lookup(&p, "server3.lan.", dns.TypeAAAA)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, net.ParseIP("2001:db8::3"), rrs[0].(*dns.AAAA).AAAA)
+	})
+
+	t.Run("IPv6 Policies", func(t *testing.T) {
+		var fp []byte
+		ipv6 := []string{
+			"2001:db8::a8bb:ccff:fedd:ee00", // eui-64
+			"2001:db8::10",                  // dhcpv6
+			"2001:db8::3c4d:5e6f:7a8b:9c0d", // temporary
+			"fd00::10",
+			"fe80::1",
+		}
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1", IPv6: ipv6},
+			},
+		})
+		defer s.Close()
+		newPlugin := func(policy ipv6Policy) *unifinames {
+			return &unifinames{
+				Config: &config{
+					TTL:   60 * 60,
+					Debug: true,
+					Controllers: []*controllerConfig{{
+						Networks: map[string]string{
+							"lan": "lan.",
+						},
+						IPv6Policies: map[string]ipv6Policy{
+							"lan": policy,
+						},
+						URL:            s.URL,
+						Site:           "default",
+						Username:       "admin",
+						Password:       "admin",
+						SSLFingerprint: fp,
+					}},
+				},
+			}
+		}
+		addresses := func(p *unifinames) []string {
+			var result []string
+			for _, rr := range lookup(p, "server1.lan.", dns.TypeAAAA) {
+				result = append(result, rr.(*dns.AAAA).AAAA.String())
+			}
+			return result
+		}
+
+		p := newPlugin(ipv6Policy{Scope: ipv6All})
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, ipv6[:4], addresses(p))
+
+		p = newPlugin(ipv6Policy{Scope: ipv6Global})
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, ipv6[:3], addresses(p))
+
+		p = newPlugin(ipv6Policy{Scope: ipv6ULA})
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, []string{"fd00::10"}, addresses(p))
+
+		p = newPlugin(ipv6Policy{Scope: ipv6Global, ExcludeTemporary: true})
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, ipv6[:2], addresses(p))
+
+		p = newPlugin(ipv6Policy{Scope: ipv6All, Max: 1})
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, ipv6[:1], addresses(p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+	})
+
+	t.Run("Two-Factor Authentication", func(t *testing.T) {
+		secret := []byte("12345678901234567890")
+		now := time.Unix(1234567890, 0)
+		for _, unifiOS := range []bool{false, true} {
+			var fp []byte
+			s := mockUnifiController(&fp, unifiOS, map[string][]mockClient{
+				"default": {{Network: "lan", Name: "server1", IP: "127.0.0.1"}},
+			})
+			s.totpCode.Store("005924")
+			newPlugin := func(secret []byte) *unifinames {
+				p := &unifinames{
+					Config: &config{
+						TTL:   60 * 60,
+						Debug: true,
+						Controllers: []*controllerConfig{{
+							Networks: map[string]string{
+								"lan": "lan.",
+							},
+							URL:            s.URL,
+							Site:           "default",
+							Username:       "admin",
+							Password:       "admin",
+							SSLFingerprint: fp,
+							TOTPSecret:     secret,
+						}},
+					},
+				}
+				p.getControllers()[0].unifi.now = func() time.Time { return now }
+				return p
+			}
+
+			p := newPlugin(nil)
+			require.Error(t, refresh(context.Background(), p))
+
+			p = newPlugin(secret)
+			require.NoError(t, refresh(context.Background(), p))
+			require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+			s.Close()
+		}
+	})
+
+	t.Run("Rotated Password", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "credentials")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		require.NoError(t, ioutil.WriteFile(dir+"/password", []byte("old"), 0600))
+		passwordFile, err := newSecretFile(dir + "/password")
+		require.NoError(t, err)
+
+		var fp []byte
+		s := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "old",
+					PasswordFile:   passwordFile,
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.Error(t, refresh(context.Background(), &p))
+
+		// the new password is used without a restart
+		require.NoError(t, ioutil.WriteFile(dir+"/password", []byte("admin\n"), 0600))
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+	})
+
+	t.Run("CA", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		newPlugin := func(rootCAs *x509.CertPool) *unifinames {
+			return &unifinames{
+				Config: &config{
+					TTL:   60 * 60,
+					Debug: true,
+					Controllers: []*controllerConfig{{
+						Networks: map[string]string{
+							"lan": "lan.",
+						},
+						URL:      s.URL,
+						Site:     "default",
+						Username: "admin",
+						Password: "admin",
+						RootCAs:  rootCAs,
+					}},
+				},
+			}
+		}
+
+		p := newPlugin(nil)
+		require.Error(t, refresh(context.Background(), p))
+
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(s.Certificate())
+		p = newPlugin(rootCAs)
+		require.NoError(t, refresh(context.Background(), p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+	})
+	t.Run("Auth Mode", func(t *testing.T) {
+		var fp []byte
+		s := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					APIKey:         "wrongkey",
+					AuthMode:       authPassword,
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(1), s.logins.Load())
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+	})
+
+	t.Run("Serve Stale", func(t *testing.T) {
+		var fp []byte
+		s := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:      60,
+				Refresh:  10 * time.Minute,
+				MinTTL:   5 * time.Second,
+				MaxStale: time.Hour,
+				StaleTTL: 2 * time.Second,
+				Debug:    true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		age := func(d time.Duration) {
+			p.mu.Lock()
+			p.records["0/default"].lastUpdate = time.Now().Add(-d)
+			p.mu.Unlock()
+		}
+		ttl := func() uint32 {
+			rrs := lookup(&p, "server1.lan.", dns.TypeA)
+			require.Equal(t, 1, len(rrs))
+			return rrs[0].Header().Ttl
+		}
+
+		// fresh records are served with the TTL, independent of the time until the next refresh
+		require.Equal(t, uint32(60), ttl())
+		age(10*time.Minute - 30*time.Second)
+		require.Equal(t, uint32(60), ttl())
+		age(10*time.Minute - time.Second)
+		require.Equal(t, uint32(60), ttl())
+		// but not below MinTTL
+		p.Config.TTL = 1
+		require.Equal(t, uint32(5), ttl())
+		p.Config.TTL = 60
+
+		// the refresh is overdue, the stale records are served with the stale ttl (but not below MinTTL)
+		age(30 * time.Minute)
+		require.Equal(t, uint32(5), ttl())
+		p.Config.MinTTL = 0
+		require.Equal(t, uint32(2), ttl())
+
+		// too stale
+		age(10*time.Minute + time.Hour)
+		require.Equal(t, 0, len(lookup(&p, "server1.lan.", dns.TypeA)))
+
+		// a failing refresh does not make the records fresh
+		s.Close()
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, 0, len(lookup(&p, "server1.lan.", dns.TypeA)))
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		var fp []byte
+		s := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		// the controller fails the first requests
+		var failures atomic.Int32
+		var status atomic.Int32
+		var requests atomic.Int32
+		handler := s.Config.Handler
+		s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Inc()
+			if failures.Load() > 0 {
+				failures.Dec()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(int(status.Load()))
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:             s.URL,
+					Site:            "default",
+					Username:        "admin",
+					Password:        "admin",
+					SSLFingerprint:  fp,
+					RetryAttempts:   3,
+					RetryMinBackoff: time.Millisecond,
+					RetryMaxBackoff: 10 * time.Millisecond,
+				}},
+			},
+		}
+		status.Store(http.StatusServiceUnavailable)
+		failures.Store(2)
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+
+		// the attempts are limited
+		requests.Store(0)
+		failures.Store(5)
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(3), requests.Load())
+
+		// the controller asks for a longer delay than the maximum backoff
+		requests.Store(0)
+		status.Store(http.StatusTooManyRequests)
+		failures.Store(1)
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(1), requests.Load())
+
+		// which is respected if it is allowed
+		p.getControllers()[0].config.RetryMaxBackoff = 2 * time.Second
+		requests.Store(0)
+		failures.Store(1)
+		start := time.Now()
+		require.NoError(t, refresh(context.Background(), &p))
+		require.True(t, time.Since(start) >= time.Second)
+
+		// requests that can not succeed are not retried
+		s.expireSessions()
+		p.getControllers()[0].config.Password = "wrong"
+		p.getControllers()[0].unifi.loggedIn = false
+		requests.Store(0)
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("Circuit Breaker", func(t *testing.T) {
+		var fp []byte
+		s := MockUnifiController(&fp, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		var logins atomic.Int32
+		handler := s.Config.Handler
+		s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/login" {
+				logins.Inc()
+			}
+			handler.ServeHTTP(w, r)
+		})
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:              s.URL,
+					Site:             "default",
+					Username:         "admin",
+					Password:         "wrong",
+					SSLFingerprint:   fp,
+					BreakerThreshold: 2,
+					BreakerCooldown:  time.Minute,
+				}},
+			},
+		}
+		now := time.Now()
+		p.getControllers()[0].unifi.now = func() time.Time { return now }
+
+		require.Error(t, refresh(context.Background(), &p))
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(2), logins.Load())
+
+		// the circuit is open, the controller is not contacted
+		err := refresh(context.Background(), &p)
+		require.True(t, errors.Is(err, errCircuitOpen), err)
+		require.Equal(t, int32(2), logins.Load())
+
+		// after the cooldown one login is attempted, it opens the circuit again if it is rejected
+		now = now.Add(time.Minute)
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(3), logins.Load())
+		require.Error(t, refresh(context.Background(), &p))
+		require.Equal(t, int32(3), logins.Load())
+
+		// a successful login closes the circuit
+		now = now.Add(time.Minute)
+		p.getControllers()[0].config.Password = "admin"
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, 1, len(lookup(&p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 0, p.getControllers()[0].unifi.rejectedLogins)
+	})
+
+	t.Run("Cache File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cache")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "127.0.0.1", IPv6: []string{"2001:db8::1"}},
+			},
+		})
+		newPlugin := func() *unifinames {
+			return &unifinames{
+				Config: &config{
+					TTL:         60 * 60,
+					MaxStale:    time.Hour,
+					StaleTTL:    30 * time.Second,
+					CacheFile:   dir + "/records.json",
+					CacheMaxAge: 24 * time.Hour,
+					Debug:       true,
+					Controllers: []*controllerConfig{{
+						Networks: map[string]string{
+							"lan": "lan.",
+						},
+						URL:            s.URL,
+						Site:           "default",
+						Username:       "admin",
+						Password:       "admin",
+						SSLFingerprint: fp,
+					}},
+				},
+			}
+		}
+
+		// nothing to restore yet
+		p := newPlugin()
+		require.NoError(t, p.loadCache())
+		require.Equal(t, 0, len(lookup(p, "server1.lan.", dns.TypeA)))
+
+		require.NoError(t, refresh(context.Background(), p))
+		s.Close()
+
+		// the controller is down after a restart
+		p = newPlugin()
+		require.NoError(t, p.loadCache())
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeAAAA)))
+		require.Error(t, refresh(context.Background(), p))
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+
+		// events do not apply to restored records
+		var msg eventMessage
+		msg.Meta.Message = "sta:sync"
+		msg.Data = []json.RawMessage{json.RawMessage(`{"mac":"aa:bb:cc:dd:ee:01","ip":"127.0.0.2","name":"server2","network":"lan"}`)}
+		p.applyEvent(p.getControllers()[0], "default", &msg)
+		require.Equal(t, 1, len(lookup(p, "server1.lan.", dns.TypeA)))
+
+		// restored records are served beyond MaxStale until they reach the maximum age
+		p.mu.Lock()
+		p.records["0/default"].lastUpdate = time.Now().Add(-3 * time.Hour)
+		p.mu.Unlock()
+		rrs := lookup(p, "server1.lan.", dns.TypeA)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, uint32(30), rrs[0].Header().Ttl)
+		p.mu.Lock()
+		p.records["0/default"].lastUpdate = time.Now().Add(-25 * time.Hour)
+		p.mu.Unlock()
+		require.Equal(t, 0, len(lookup(p, "server1.lan.", dns.TypeA)))
+
+		// the cache file is too old
+		p = newPlugin()
+		p.Config.CacheMaxAge = time.Nanosecond
+		require.NoError(t, p.loadCache())
+		require.Equal(t, 0, len(lookup(p, "server1.lan.", dns.TypeA)))
+
+		// the controller is no longer configured
+		p = newPlugin()
+		p.Config.Controllers[0].URL = "https://other.example.com"
+		require.NoError(t, p.loadCache())
+		require.Equal(t, 0, len(lookup(p, "server1.lan.", dns.TypeA)))
+
+		// a broken cache file
+		require.NoError(t, ioutil.WriteFile(dir+"/records.json", []byte("{"), 0600))
+		require.Error(t, newPlugin().loadCache())
+
+		// controllers that share an url keep their sites
+		s = mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {{Network: "lan", Name: "server1", IP: "127.0.0.1"}},
+			"office":  {{Network: "lan", Name: "server2", IP: "127.0.0.2"}},
+		})
+		defer s.Close()
+		newPlugin = func() *unifinames {
+			p := &unifinames{
+				Config: &config{
+					TTL:         60 * 60,
+					CacheFile:   dir + "/records.json",
+					CacheMaxAge: 24 * time.Hour,
+				},
+			}
+			for _, site := range []string{"default", "office"} {
+				p.Config.Controllers = append(p.Config.Controllers, &controllerConfig{
+					Networks:       map[string]string{"lan": site + "."},
+					URL:            s.URL,
+					Site:           site,
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				})
+			}
+			return p
+		}
+		p = newPlugin()
+		require.NoError(t, refresh(context.Background(), p))
+		p = newPlugin()
+		require.NoError(t, p.loadCache())
+		require.Equal(t, 2, len(p.records))
+		require.Equal(t, []string{"default."}, p.records["0/default"].domains)
+		require.Equal(t, []string{"office."}, p.records["1/office"].domains)
+	})
+
+	t.Run("PTR", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "192.168.1.10", IPv6: []string{"2001:db8::10"}},
+				{Network: "lan", Name: "server2", IP: "192.168.1.20"},
+			},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan": "lan.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+
+		rrs := lookup(&p, "10.1.168.192.in-addr.arpa.", dns.TypePTR)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "server1.lan.", rrs[0].(*dns.PTR).Ptr)
+		require.Equal(t, uint32(3600), rrs[0].Header().Ttl)
+
+		rrs = lookup(&p, "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.IP6.ARPA.", dns.TypePTR)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "server1.lan.", rrs[0].(*dns.PTR).Ptr)
+
+		require.Equal(t, 0, len(lookup(&p, "30.1.168.192.in-addr.arpa.", dns.TypePTR)))
+
+		// only the declared reverse zones are answered
+		p.Config.ReverseZones = []string{"1.168.192.in-addr.arpa."}
+		require.Equal(t, 1, len(lookup(&p, "20.1.168.192.in-addr.arpa.", dns.TypePTR)))
+		require.Equal(t, 0, len(lookup(&p, "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR)))
+	})
+
+	t.Run("Authoritative", func(t *testing.T) {
+		var fp []byte
+		s := mockUnifiController(&fp, false, map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "192.168.1.10"},
+				{Network: "servers", Name: "web", IP: "192.168.2.10"},
+			},
+		})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:          60 * 60,
+				Debug:        true,
+				ReverseZones: []string{"168.192.in-addr.arpa."},
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan":     "lan.",
+						"servers": "prod.servers.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		query := func(name string, qtype uint16) *dns.Msg {
+			d := &dummyResponseWriter{}
+			p.ServeDNS(context.Background(), d, &dns.Msg{
+				Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: qtype}},
+			})
+			if len(d.GetMsgs()) == 0 {
+				return nil
+			}
+			return d.GetMsgs()[0]
+		}
+		p.haveRoutine.Store(true)
+
+		// the controller was not reached yet
+		require.Nil(t, query("server2.lan.", dns.TypeA))
+
+		require.NoError(t, refresh(context.Background(), &p))
+
+		m := query("server1.lan.", dns.TypeA)
+		require.True(t, m.Authoritative)
+		require.Equal(t, 1, len(m.Answer))
+
+		// NODATA
+		m = query("server1.lan.", dns.TypeAAAA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.True(t, m.Authoritative)
+		require.Equal(t, 0, len(m.Answer))
+		require.Equal(t, "lan.", m.Ns[0].Header().Name)
+		require.Equal(t, uint32(60), m.Ns[0].(*dns.SOA).Minttl)
+
+		m = query("lan.", dns.TypeMX)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+
+		// NXDOMAIN
+		m = query("server2.lan.", dns.TypeA)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+		require.True(t, m.Authoritative)
+		require.Equal(t, "lan.", m.Ns[0].Header().Name)
+
+		m = query("20.1.168.192.in-addr.arpa.", dns.TypePTR)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+		require.Equal(t, "168.192.in-addr.arpa.", m.Ns[0].Header().Name)
+
+		// empty non-terminals exist
+		m = query("1.168.192.in-addr.arpa.", dns.TypePTR)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+
+		// other zones are passed to the next plugin
+		require.Nil(t, query("example.com.", dns.TypeA))
+		require.Nil(t, query("20.1.10.in-addr.arpa.", dns.TypePTR))
+
+		// fallthrough for some zones
+		p.Config.Fall.SetZonesFromArgs([]string{"servers."})
+		require.Nil(t, query("db.prod.servers.", dns.TypeA))
+		require.Equal(t, dns.RcodeNameError, query("server2.lan.", dns.TypeA).Rcode)
+	})
+
+	t.Run("SOA And NS", func(t *testing.T) {
+		var fp []byte
+		sites := map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "192.168.1.10"},
+				{Network: "servers", Name: "web", IP: "192.168.2.10"},
+			},
+		}
+		s := mockUnifiController(&fp, false, sites)
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:          60 * 60,
+				Debug:        true,
+				ReverseZones: []string{"168.192.in-addr.arpa."},
+				NS:           []string{"ns1.example.com.", "ns2.example.com."},
+				SOA: soaConfig{
+					RName:   "admin.example.com.",
+					Minimum: 10 * time.Second,
+				},
+				Controllers: []*controllerConfig{{
+					Networks: map[string]string{
+						"lan":     "lan.",
+						"servers": "servers.",
+					},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		serial := func(zone string) uint32 {
+			rrs := lookup(&p, zone, dns.TypeSOA)
+			require.Equal(t, 1, len(rrs))
+			return rrs[0].(*dns.SOA).Serial
+		}
+
+		// the controller was not reached yet
+		require.Equal(t, 0, len(lookup(&p, "lan.", dns.TypeSOA)))
+
+		require.NoError(t, refresh(context.Background(), &p))
+		rrs := lookup(&p, "lan.", dns.TypeSOA)
+		require.Equal(t, 1, len(rrs))
+		soa := rrs[0].(*dns.SOA)
+		require.Equal(t, "lan.", soa.Hdr.Name)
+		require.Equal(t, "ns1.example.com.", soa.Ns)
+		require.Equal(t, "admin.example.com.", soa.Mbox)
+		require.Equal(t, uint32(3600), soa.Refresh)
+		require.Equal(t, uint32(10), soa.Minttl)
+		require.True(t, soa.Serial >= uint32(time.Now().Unix())-1)
+
+		rrs = lookup(&p, "168.192.in-addr.arpa.", dns.TypeNS)
+		require.Equal(t, 2, len(rrs))
+		require.Equal(t, "ns1.example.com.", rrs[0].(*dns.NS).Ns)
+		require.Equal(t, "ns2.example.com.", rrs[1].(*dns.NS).Ns)
+
+		// only the apex has SOA and NS records
+		require.Equal(t, 0, len(lookup(&p, "server1.lan.", dns.TypeSOA)))
+
+		// the serial does not change if the records do not change
+		lan, servers, reverse := serial("lan."), serial("servers."), serial("168.192.in-addr.arpa.")
+		require.NoError(t, refresh(context.Background(), &p))
+		require.Equal(t, lan, serial("lan."))
+
+		// the serials of the changed zones increase
+		sites["default"] = append(sites["default"], mockClient{Network: "lan", Name: "server2", IP: "192.168.1.20"})
+		require.NoError(t, refresh(context.Background(), &p))
+		require.True(t, serial("lan.") > lan)
+		require.Equal(t, servers, serial("servers."))
+		require.True(t, serial("168.192.in-addr.arpa.") > reverse)
+
+		// negative answers are cached for the minimum
+		d := &dummyResponseWriter{}
+		p.haveRoutine.Store(true)
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: "server3.lan.", Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, uint32(10), d.GetMsgs()[0].Ns[0].Header().Ttl)
+
+		// without name servers there are no NS records, a made up name would make the delegation lame
+		p.Config.NS = nil
+		require.Equal(t, 0, len(lookup(&p, "lan.", dns.TypeNS)))
+		rrs = lookup(&p, "168.192.in-addr.arpa.", dns.TypeSOA)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, hostname(), rrs[0].(*dns.SOA).Ns)
+		d = &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: "lan.", Qclass: dns.ClassINET, Qtype: dns.TypeNS}},
+		})
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeSuccess, d.GetMsgs()[0].Rcode)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+	})
+
+	t.Run("Zone Transfer", func(t *testing.T) {
+		var fp []byte
+		sites := map[string][]mockClient{
+			"default": {
+				{Network: "lan", Name: "server1", IP: "192.168.1.10"},
+			},
+		}
+		s := mockUnifiController(&fp, false, sites)
+		defer s.Close()
+
+		notifies := make(chan string, 16)
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		secondary := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+			if r.Opcode == dns.OpcodeNotify {
+				notifies <- r.Question[0].Name
+			}
+		})}
+		go secondary.ActivateAndServe()
+		defer secondary.Shutdown()
+
+		p := unifinames{
+			Config: &config{
+				TTL:          60 * 60,
+				Debug:        true,
+				ReverseZones: []string{"168.192.in-addr.arpa."},
+				NS:           []string{"ns1.example.com."},
+				Transfer: &transferConfig{
+					To:     []string{"127.0.0.1", "10.0.0.0/8"},
+					Notify: []string{pc.LocalAddr().String()},
+				},
+				Controllers: []*controllerConfig{{
+					Networks:       map[string]string{"lan": "lan."},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		p.haveRoutine.Store(true)
+		require.NoError(t, refresh(context.Background(), &p))
+
+		// every changed zone is notified, the test waits for all of them so no notify outlives it
+		notified := func(zones ...string) {
+			pending := make(map[string]bool)
+			for _, zone := range zones {
+				pending[zone] = true
+			}
+			for len(pending) > 0 {
+				select {
+				case name := <-notifies:
+					delete(pending, name)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no notify for %v", pending)
+				}
+			}
+		}
+		notified("lan.", "168.192.in-addr.arpa.")
+
+		xfr := func(remote string, qtype uint16, serial uint32) (*dummyResponseWriter, int) {
+			d := &dummyResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP(remote), Port: 53000}}
+			r := new(dns.Msg)
+			r.SetQuestion("lan.", qtype)
+			if qtype == dns.TypeIXFR {
+				r.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "lan.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: serial}}
+			}
+			rcode, err := p.ServeDNS(context.Background(), d, r)
+			require.NoError(t, err)
+			return d, rcode
+		}
+		answer := func(d *dummyResponseWriter) []dns.RR {
+			var rrs []dns.RR
+			for _, m := range d.GetMsgs() {
+				rrs = append(rrs, m.Answer...)
+			}
+			return rrs
+		}
+
+		// a full transfer starts and ends with the SOA
+		d, rcode := xfr("10.1.2.3", dns.TypeAXFR, 0)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		rrs := answer(d)
+		require.Equal(t, 4, len(rrs))
+		soa := rrs[0].(*dns.SOA)
+		require.Equal(t, dns.TypeNS, rrs[1].Header().Rrtype)
+		require.Equal(t, "server1.lan.", rrs[2].Header().Name)
+		require.Equal(t, "192.168.1.10", rrs[2].(*dns.A).A.String())
+		require.Equal(t, soa.String(), rrs[3].String())
+
+		// other secondaries are refused
+		d, rcode = xfr("192.168.1.20", dns.TypeAXFR, 0)
+		require.Equal(t, dns.RcodeRefused, rcode)
+		require.Equal(t, 0, len(d.GetMsgs()))
+
+		// a current secondary only gets the SOA
+		d, _ = xfr("127.0.0.1", dns.TypeIXFR, soa.Serial)
+		rrs = answer(d)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, soa.Serial, rrs[0].(*dns.SOA).Serial)
+
+		// an incremental transfer holds the changes since the serial of the secondary
+		sites["default"] = []mockClient{{Network: "lan", Name: "server2", IP: "192.168.1.20"}}
+		require.NoError(t, refresh(context.Background(), &p))
+		notified("lan.", "168.192.in-addr.arpa.")
+		d, _ = xfr("127.0.0.1", dns.TypeIXFR, soa.Serial)
+		rrs = answer(d)
+		require.Equal(t, 6, len(rrs))
+		current := rrs[0].(*dns.SOA).Serial
+		require.True(t, current > soa.Serial)
+		require.Equal(t, soa.Serial, rrs[1].(*dns.SOA).Serial)
+		require.Equal(t, "server1.lan.", rrs[2].Header().Name)
+		require.Equal(t, current, rrs[3].(*dns.SOA).Serial)
+		require.Equal(t, "server2.lan.", rrs[4].Header().Name)
+		require.Equal(t, current, rrs[5].(*dns.SOA).Serial)
+
+		// the reverse zone holds the PTR records
+		reverse, err := p.Transfer("168.192.in-addr.arpa", 0)
+		require.NoError(t, err)
+		rrs = <-reverse
+		require.Equal(t, 3, len(rrs))
+		require.Equal(t, "server2.lan.", rrs[2].(*dns.PTR).Ptr)
+
+		// unknown serials get a full transfer
+		d, _ = xfr("127.0.0.1", dns.TypeIXFR, 1)
+		rrs = answer(d)
+		require.Equal(t, 4, len(rrs))
+		require.Equal(t, dns.TypeNS, rrs[1].Header().Rrtype)
+		_, err = p.Transfer("example.com.", 0)
+		require.Equal(t, transfer.ErrNotAuthoritative, err)
+
+		// transfers need tcp
+		d = &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53000}}
+		r := new(dns.Msg)
+		r.SetQuestion("lan.", dns.TypeAXFR)
+		rcode, err = p.ServeDNS(context.Background(), d, r)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeRefused, rcode)
+		require.Equal(t, 0, len(d.GetMsgs()))
+
+		// with a key the transfers must be signed, the plugin has its own config so the notifies above
+		// never see it change
+		secret := base64.StdEncoding.EncodeToString([]byte("secondary secret"))
+		signed := &unifinames{
+			Config: &config{
+				TTL: 60 * 60,
+				NS:  []string{"ns1.example.com."},
+				Transfer: &transferConfig{
+					To:            []string{"127.0.0.1"},
+					TSIGKey:       "secondary.",
+					TSIGAlgorithm: dns.HmacSHA256,
+					TSIGSecret:    secret,
+				},
+				Controllers: []*controllerConfig{{
+					Networks:       map[string]string{"lan": "lan."},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		signed.haveRoutine.Store(true)
+		require.NoError(t, refresh(context.Background(), signed))
+		_, err = signed.Transfer("lan.", 0)
+		require.Error(t, err)
+
+		serve := func(buf []byte) (*dummyResponseWriter, *dns.Msg, int) {
+			d := &dummyResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53000}}
+			r := new(dns.Msg)
+			require.NoError(t, r.Unpack(buf))
+			rcode, err := signed.ServeDNS(context.Background(), d, r)
+			require.NoError(t, err)
+			return d, r, rcode
+		}
+		unsigned, err := new(dns.Msg).SetQuestion("lan.", dns.TypeAXFR).Pack()
+		require.NoError(t, err)
+		d, _, rcode = serve(unsigned)
+		require.Equal(t, dns.RcodeRefused, rcode)
+		require.Equal(t, 0, len(d.GetBytes()))
+
+		sign := func(secret string) []byte {
+			m := new(dns.Msg)
+			m.SetQuestion("lan.", dns.TypeAXFR)
+			m.SetTsig("secondary.", dns.HmacSHA256, 300, time.Now().Unix())
+			buf, _, err := dns.TsigGenerate(m, secret, "", false)
+			require.NoError(t, err)
+			return buf
+		}
+		_, _, rcode = serve(sign(base64.StdEncoding.EncodeToString([]byte("wrong secret"))))
+		require.Equal(t, dns.RcodeRefused, rcode)
+		d, r, rcode = serve(sign(secret))
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.NoError(t, dns.TsigVerify(d.GetBytes(), secret, r.IsTsig().MAC, false))
+		res := new(dns.Msg)
+		require.NoError(t, res.Unpack(d.GetBytes()))
+		require.Equal(t, 4, len(res.Answer))
+
+		// BIND and Knot compress every name of the request, the names keep their case; compressOwner selects
+		// whether the owner of the SOA points to the question
+		ixfr := func(compressOwner bool) []byte {
+			msg := make([]byte, dns.MaxMsgSize)
+			binary.BigEndian.PutUint16(msg[0:], 0x1234)
+			binary.BigEndian.PutUint16(msg[4:], 1)
+			binary.BigEndian.PutUint16(msg[8:], 1)
+			compression := make(map[string]int)
+			off, err := dns.PackDomainName("LAN.", msg, 12, compression, true)
+			require.NoError(t, err)
+			binary.BigEndian.PutUint16(msg[off:], dns.TypeIXFR)
+			binary.BigEndian.PutUint16(msg[off+2:], dns.ClassINET)
+			off, err = dns.PackDomainName("LAN.", msg, off+4, compression, compressOwner)
+			require.NoError(t, err)
+			binary.BigEndian.PutUint16(msg[off:], dns.TypeSOA)
+			binary.BigEndian.PutUint16(msg[off+2:], dns.ClassINET)
+			rdata := off + 10
+			off, err = dns.PackDomainName("ns1.Example.com.", msg, rdata, compression, true)
+			require.NoError(t, err)
+			off, err = dns.PackDomainName("hostmaster.Example.com.", msg, off, compression, true)
+			require.NoError(t, err)
+			binary.BigEndian.PutUint32(msg[off:], signed.soa("lan.").Serial)
+			off += 20
+			binary.BigEndian.PutUint16(msg[rdata-2:], uint16(off-rdata))
+			return msg[:off]
+		}
+
+		// the signature covers the request and the variables of the TSIG record (RFC 8945 4.3.3)
+		signWire := func(msg []byte) []byte {
+			key, err := base64.StdEncoding.DecodeString(secret)
+			require.NoError(t, err)
+			tsig := &dns.TSIG{
+				Hdr:        dns.RR_Header{Name: "secondary.", Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+				Algorithm:  dns.HmacSHA256,
+				TimeSigned: uint64(time.Now().Unix()),
+				Fudge:      300,
+				OrigId:     0x1234,
+			}
+			variables := make([]byte, 512)
+			n, err := dns.PackDomainName(tsig.Hdr.Name, variables, 0, nil, false)
+			require.NoError(t, err)
+			binary.BigEndian.PutUint16(variables[n:], dns.ClassANY)
+			n, err = dns.PackDomainName(tsig.Algorithm, variables, n+6, nil, false)
+			require.NoError(t, err)
+			binary.BigEndian.PutUint16(variables[n:], uint16(tsig.TimeSigned>>32))
+			binary.BigEndian.PutUint32(variables[n+2:], uint32(tsig.TimeSigned))
+			binary.BigEndian.PutUint16(variables[n+6:], tsig.Fudge)
+			mac := hmac.New(sha256.New, key)
+			mac.Write(msg)
+			mac.Write(variables[:n+12])
+			tsig.MAC = hex.EncodeToString(mac.Sum(nil))
+			tsig.MACSize = uint16(len(tsig.MAC) / 2)
+			request := make([]byte, dns.MaxMsgSize)
+			copy(request, msg)
+			binary.BigEndian.PutUint16(request[10:], 1)
+			off, err := dns.PackRR(tsig, request, len(msg), nil, false)
+			require.NoError(t, err)
+			return request[:off]
+		}
+
+		d, r, rcode = serve(signWire(ixfr(true)))
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.NoError(t, dns.TsigVerify(d.GetBytes(), secret, r.IsTsig().MAC, false))
+		res = new(dns.Msg)
+		require.NoError(t, res.Unpack(d.GetBytes()))
+		require.Equal(t, 1, len(res.Answer))
+		require.Equal(t, dns.TypeSOA, res.Answer[0].Header().Rrtype)
+
+		// the request is packed again to verify it, encodings that neither miekg/dns nor BIND or Knot send
+		// are refused
+		_, _, rcode = serve(signWire(ixfr(false)))
+		require.Equal(t, dns.RcodeRefused, rcode)
+	})
+
+	t.Run("RRset", func(t *testing.T) {
+		var fp []byte
+		clients := []mockClient{
+			{Network: "lan", Name: "server", IP: "192.168.1.10"},
+			{Network: "lan", Name: "Server", IP: "192.168.1.11"},
+			{Network: "lan", Name: "server", IP: "192.168.1.10"},
+			{Network: "lan", Name: "server", IP: "192.168.1.12", IPv6: []string{"2001:db8::10", "2001:db8::11"}},
+		}
+		for i := 0; i < 40; i++ {
+			clients = append(clients, mockClient{Network: "lan", Name: "big", IP: fmt.Sprintf("192.168.2.%d", i+1)})
+		}
+		s := mockUnifiController(&fp, false, map[string][]mockClient{"default": clients})
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				TTL:   60 * 60,
+				Debug: true,
+				Order: orderFixed,
+				Controllers: []*controllerConfig{{
+					Networks:       map[string]string{"lan": "lan."},
+					URL:            s.URL,
+					Site:           "default",
+					Username:       "admin",
+					Password:       "admin",
+					SSLFingerprint: fp,
+				}},
+			},
+		}
+		require.NoError(t, refresh(context.Background(), &p))
+		addresses := func(rrs []dns.RR) []string {
+			var ips []string
+			for _, rr := range rrs {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A.String())
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA.String())
+				}
+			}
+			return ips
+		}
+
+		// every address of the name is answered once
+		require.Equal(t, []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"}, addresses(lookup(&p, "server.lan.", dns.TypeA)))
+		require.Equal(t, []string{"2001:db8::10", "2001:db8::11"}, addresses(lookup(&p, "server.lan.", dns.TypeAAAA)))
+
+		p.Config.Order = orderRoundRobin
+		first := addresses(lookup(&p, "server.lan.", dns.TypeA))
+		second := addresses(lookup(&p, "server.lan.", dns.TypeA))
+		require.Equal(t, 3, len(first))
+		require.Equal(t, append(first[1:], first[0]), second)
+
+		p.Config.Order = orderShuffle
+		require.ElementsMatch(t, []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"}, addresses(lookup(&p, "server.lan.", dns.TypeA)))
+
+		// udp answers are truncated to the buffer size of the client
+		query := func(remote net.Addr, bufsize uint16) *dns.Msg {
+			d := &dummyResponseWriter{remoteAddr: remote}
+			r := new(dns.Msg)
+			r.SetQuestion("big.lan.", dns.TypeA)
+			if bufsize > 0 {
+				r.SetEdns0(bufsize, false)
+			}
+			require.True(t, p.resolve(d, r))
+			return d.GetMsgs()[0]
+		}
+		udp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53000}
+		m := query(udp, 0)
+		require.True(t, m.Truncated)
+		require.True(t, len(m.Answer) < 40)
+		require.LessOrEqual(t, m.Len(), dns.MinMsgSize)
+
+		m = query(udp, 4096)
+		require.False(t, m.Truncated)
+		require.Equal(t, 40, len(m.Answer))
+		require.NotNil(t, m.IsEdns0())
+
+		m = query(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53000}, 0)
+		require.False(t, m.Truncated)
+		require.Equal(t, 40, len(m.Answer))
+	})
 }
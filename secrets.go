@@ -0,0 +1,84 @@
+package unifinames
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reEnvPlaceholder = regexp.MustCompile(`\{env\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the {env.VAR} placeholders in s with the value of the environment variable.
+// Unset variables are an error, the error never contains a value.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := reEnvPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := reEnvPlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable `%s' is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// secretFile is a file that holds a secret (e.g. a mounted docker or kubernetes secret),
+// it is read again when it changes so the secret can rotate.
+type secretFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func newSecretFile(path string) (*secretFile, error) {
+	f := &secretFile{path: path}
+	if _, err := f.read(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// read returns the secret, surrounding whitespace is removed.
+// If the file can not be read the last value that was read is returned with the error.
+func (f *secretFile) read() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.value, fmt.Errorf("unable to read `%s': %w", f.path, err)
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.value, nil
+	}
+
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.value, fmt.Errorf("unable to read `%s': %w", f.path, err)
+	}
+	f.value = strings.TrimSpace(string(buf))
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return f.value, nil
+}
+
+// secret returns the value of file, or value if there is no file.
+// If the file can not be read the last value that was read from it is used, so a rotated secret is kept.
+func secret(value string, file *secretFile) string {
+	if file == nil {
+		return value
+	}
+	v, err := file.read()
+	if err != nil {
+		log.Printf("[unifi-names] %v, using the previous value\n", err)
+	}
+	return v
+}
@@ -1,8 +1,11 @@
 package unifinames
 
 import (
+	"log"
+
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 
 	"github.com/caddyserver/caddy"
 )
@@ -21,8 +24,20 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("unifi-names", err)
 	}
 
+	p := &unifinames{Config: config, done: make(chan struct{})}
+	c.OnStartup(func() error {
+		metrics.MustRegister(c, activeEndpoint, failoverCount)
+		// a cache that can not be read is not fatal, the records are fetched from the controllers
+		if err := p.loadCache(); err != nil {
+			log.Printf("[unifi-names] %v\n", err)
+		}
+		return nil
+	})
+	c.OnShutdown(p.close)
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return &unifinames{Next: next, Config: config}
+		p.Next = next
+		return p
 	})
 
 	return nil
@@ -0,0 +1,45 @@
+package unifinames
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// totpPeriod is the lifetime of a one-time code
+	totpPeriod = 30 * time.Second
+	// totpDigits is the length of a one-time code
+	totpDigits = 6
+)
+
+// parseTOTPSecret decodes a base32 encoded totp secret, as it is shown when 2fa is set up.
+func parseTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid totp secret: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("invalid totp secret: empty")
+	}
+	return secret, nil
+}
+
+// totp returns the one-time code of secret at t (RFC 6238).
+func totp(secret []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(totpPeriod/time.Second)))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
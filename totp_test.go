@@ -0,0 +1,43 @@
+package unifinames
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238 (truncated to 6 digits)
+	secret := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		require.Equal(t, code, totp(secret, time.Unix(unix, 0)), "at %d", unix)
+	}
+}
+
+func TestParseTOTPSecret(t *testing.T) {
+	encoded := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	secret, err := parseTOTPSecret(encoded)
+	require.NoError(t, err)
+	require.Equal(t, []byte("12345678901234567890"), secret)
+
+	// as it is shown by authenticator apps
+	secret, err = parseTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq\n")
+	require.NoError(t, err)
+	require.Equal(t, []byte("12345678901234567890"), secret)
+
+	_, err = parseTOTPSecret("not base32!")
+	require.Error(t, err)
+
+	_, err = parseTOTPSecret("")
+	require.Error(t, err)
+}
@@ -0,0 +1,277 @@
+package unifinames
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// transferChunk is the maximum number of records per message of a zone transfer
+	transferChunk = 500
+	// tsigFudge is the permitted clock skew of signed messages in seconds
+	tsigFudge = 300
+	// notifyAttempts is the number of attempts to notify a secondary of a change
+	notifyAttempts = 3
+	// notifyTimeout is the timeout of a NOTIFY
+	notifyTimeout = 5 * time.Second
+)
+
+// notifyBackoff is the delay before a NOTIFY is sent again, it grows with every attempt.
+var notifyBackoff = 10 * time.Second
+
+// errTSIGRequired is returned to the transfer plugin if the transfers must be signed,
+// the transfer plugin can not verify signatures.
+var errTSIGRequired = errors.New("transfers must be signed, they are only answered by unifi-names itself")
+
+// Transfer implements the transfer.Transferer interface, so the zones can be transferred by the transfer plugin.
+func (p *unifinames) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	if p.Config.Transfer != nil && p.Config.Transfer.TSIGKey != "" {
+		return nil, errTSIGRequired
+	}
+	rrs, err := p.transferRecords(strings.ToLower(dns.Fqdn(zone)), serial)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []dns.RR, 1)
+	ch <- rrs
+	close(ch)
+	return ch, nil
+}
+
+// transferRecords returns the records of a transfer of zone without the closing SOA.
+// If serial is 0 (AXFR) or not in the journal all records are returned, if it is current only the SOA is returned,
+// otherwise the changes since serial are returned (IXFR).
+func (p *unifinames) transferRecords(zone string, serial uint32) ([]dns.RR, error) {
+	if p.zone(zone) != zone {
+		return nil, transfer.ErrNotAuthoritative
+	}
+	if !p.available(zone) {
+		return nil, fmt.Errorf("there are no records for `%s'", zone)
+	}
+
+	soa := p.soa(zone)
+	p.mu.Lock()
+	state := p.serials[zone]
+	p.mu.Unlock()
+	soa.Serial = state.serial
+
+	if serial != 0 {
+		if int32(serial-state.serial) >= 0 {
+			return []dns.RR{soa}, nil
+		}
+		for i, entry := range state.journal {
+			if entry.from != serial {
+				continue
+			}
+			rrs := []dns.RR{soa}
+			for _, entry := range state.journal[i:] {
+				from, to := *soa, *soa
+				from.Serial, to.Serial = entry.from, entry.to
+				rrs = append(rrs, &from)
+				rrs = append(rrs, entry.deleted...)
+				rrs = append(rrs, &to)
+				rrs = append(rrs, entry.added...)
+			}
+			return rrs, nil
+		}
+	}
+
+	rrs := []dns.RR{soa}
+	rrs = append(rrs, p.apex(zone, dns.TypeNS)...)
+	return append(rrs, state.rrs...), nil
+}
+
+// serveTransfer answers AXFR and IXFR requests for the zones, the secondary must be allowed by the
+// Transfer block and the request must be signed with its key (if one is set).
+// Without a Transfer block the requests are passed to the next plugin.
+func (p *unifinames) serveTransfer(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	question := r.Question[0]
+	name := strings.ToLower(question.Name)
+	zone := p.zone(name)
+	if zone == "" || p.Config.Transfer == nil {
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+	// transfers are answered with several messages, they need tcp
+	state := request.Request{W: w, Req: r}
+	if zone != name || state.Proto() != "tcp" || !p.transferAllowed(w, r) {
+		log.Printf("[unifi-names] refusing transfer of `%s' to %s\n", name, w.RemoteAddr())
+		return dns.RcodeRefused, nil
+	}
+
+	var serial uint32
+	if question.Qtype == dns.TypeIXFR {
+		if len(r.Ns) == 0 {
+			return dns.RcodeFormatError, nil
+		}
+		soa, ok := r.Ns[0].(*dns.SOA)
+		if !ok {
+			return dns.RcodeFormatError, nil
+		}
+		serial = soa.Serial
+	}
+
+	rrs, err := p.transferRecords(zone, serial)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	// an IXFR of a current zone is answered with the SOA only, every other transfer ends with the SOA
+	if serial == 0 || len(rrs) > 1 {
+		rrs = append(rrs, rrs[0])
+	}
+	if err := p.writeTransfer(w, r, rrs); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	log.Printf("[unifi-names] transferred %d records of `%s' to %s\n", len(rrs), zone, w.RemoteAddr())
+	return dns.RcodeSuccess, nil
+}
+
+// transferAllowed reports whether the sender of r may transfer the zones.
+func (p *unifinames) transferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	cfg := p.Config.Transfer
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+
+	var allowed bool
+	for _, to := range cfg.To {
+		if to == "*" {
+			allowed = true
+		} else if _, network, err := net.ParseCIDR(to); err == nil {
+			allowed = allowed || network.Contains(remote)
+		} else {
+			allowed = allowed || net.ParseIP(to).Equal(remote)
+		}
+	}
+	if !allowed {
+		if p.Config.Debug {
+			log.Printf("[unifi-names] %s is not allowed to transfer the zones\n", remote)
+		}
+		return false
+	}
+	if cfg.TSIGKey == "" {
+		return true
+	}
+
+	tsig := r.IsTsig()
+	if tsig == nil {
+		if p.Config.Debug {
+			log.Printf("[unifi-names] the transfer request of %s is not signed\n", remote)
+		}
+		return false
+	}
+	if !strings.EqualFold(tsig.Hdr.Name, cfg.TSIGKey) || !strings.EqualFold(tsig.Algorithm, cfg.TSIGAlgorithm) {
+		if p.Config.Debug {
+			log.Printf("[unifi-names] the transfer request of %s is signed with the unknown key `%s' (%s)\n", remote, tsig.Hdr.Name, tsig.Algorithm)
+		}
+		return false
+	}
+	// CoreDNS 1.7.0 neither verifies TSIG nor passes the request on in wire form (there is no TsigSecret
+	// of the server and no tsig plugin), so as a workaround the request is packed again to verify it.
+	// The names keep their case, miekg/dns clients send the request uncompressed, BIND and Knot compress
+	// every name (like miekg/dns with compression), other encodings are refused.
+	for _, compress := range []bool{false, true} {
+		m := r.Copy()
+		m.Compress = compress
+		buf, err := m.Pack()
+		if err == nil {
+			if err = dns.TsigVerify(buf, cfg.TSIGSecret, "", false); err == nil {
+				return true
+			}
+		}
+		if p.Config.Debug {
+			log.Printf("[unifi-names] the signature of the transfer request of %s does not verify (compressed: %t): %v\n", remote, compress, err)
+		}
+	}
+	return false
+}
+
+// writeTransfer writes rrs in messages of up to transferChunk records, they are signed if r is signed.
+func (p *unifinames) writeTransfer(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) error {
+	cfg := p.Config.Transfer
+	tsig := r.IsTsig()
+	var requestMAC string
+	if tsig != nil {
+		requestMAC = tsig.MAC
+	}
+
+	for i := 0; i < len(rrs); i += transferChunk {
+		end := i + transferChunk
+		if end > len(rrs) {
+			end = len(rrs)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = rrs[i:end]
+
+		if tsig == nil || cfg.TSIGKey == "" {
+			if err := w.WriteMsg(m); err != nil {
+				return err
+			}
+			continue
+		}
+		// the following messages only cover the timers (RFC 8945 5.3.1)
+		m.SetTsig(cfg.TSIGKey, cfg.TSIGAlgorithm, tsigFudge, time.Now().Unix())
+		buf, mac, err := dns.TsigGenerate(m, cfg.TSIGSecret, requestMAC, i > 0)
+		if err != nil {
+			return err
+		}
+		requestMAC = mac
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify sends a NOTIFY of the new serial of zone to the secondaries,
+// a secondary that does not acknowledge it is notified again a few times.
+func (p *unifinames) notify(zone string, serial uint32) {
+	cfg := p.Config.Transfer
+	for _, to := range cfg.Notify {
+		go func(to string) {
+			c := &dns.Client{Timeout: notifyTimeout}
+			if cfg.TSIGKey != "" {
+				c.TsigSecret = map[string]string{cfg.TSIGKey: cfg.TSIGSecret}
+			}
+			for attempt := 1; ; attempt++ {
+				m := new(dns.Msg)
+				m.SetNotify(zone)
+				if cfg.TSIGKey != "" {
+					m.SetTsig(cfg.TSIGKey, cfg.TSIGAlgorithm, tsigFudge, time.Now().Unix())
+				}
+				res, _, err := c.Exchange(m, to)
+				if err == nil && res.Rcode == dns.RcodeSuccess {
+					if p.Config.Debug {
+						log.Printf("[unifi-names] notified `%s' of serial %d of `%s'\n", to, serial, zone)
+					}
+					return
+				}
+				if err == nil {
+					err = fmt.Errorf("got %s", dns.RcodeToString[res.Rcode])
+				}
+				log.Printf("[unifi-names] unable to notify `%s' of serial %d of `%s': %v\n", to, serial, zone, err)
+				if attempt >= notifyAttempts {
+					return
+				}
+				select {
+				case <-time.After(time.Duration(attempt) * notifyBackoff):
+				case <-p.done:
+					return
+				}
+			}
+		}(to)
+	}
+}
@@ -0,0 +1,552 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	reSetCookieToken   = regexp.MustCompile(`unifises=([0-9a-zA-Z]+)`)
+	reSetCookieOSToken = regexp.MustCompile(`TOKEN=([0-9a-zA-Z._-]+)`)
+
+	errLoginRequired = errors.New("login required")
+	errCircuitOpen   = errors.New("circuit breaker is open")
+)
+
+// endpointError marks errors caused by an unreachable or failing controller endpoint,
+// they make the client switch to the next endpoint.
+type endpointError struct {
+	error
+}
+
+func (e endpointError) Unwrap() error { return e.error }
+
+// throttledError marks requests that were rejected because of too many requests (429),
+// retryAfter is the delay the controller asked for (0 if it did not).
+type throttledError struct {
+	error
+	retryAfter time.Duration
+}
+
+func (e throttledError) Unwrap() error { return e.error }
+
+// newThrottledError returns the error of a throttled response res.
+func newThrottledError(err error, res *http.Response) throttledError {
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return throttledError{error: err, retryAfter: retryAfter}
+}
+
+// unifiClient keeps one session to the unifi controller open between refreshes.
+type unifiClient struct {
+	config    *controllerConfig
+	debug     bool
+	client    *http.Client
+	tlsConfig *tls.Config
+	// urls are the endpoints of the controller, the first one is the primary
+	urls []string
+	// now is the clock of the one-time codes
+	now func() time.Time
+
+	mu        sync.Mutex
+	active    int
+	detected  bool
+	unifiOS   bool
+	loggedIn  bool
+	csrfToken string
+	// rejectedLogins is the number of consecutive rejected logins,
+	// no login is attempted until blockedUntil once it reaches the threshold of the circuit breaker
+	rejectedLogins int
+	blockedUntil   time.Time
+}
+
+func newUnifiClient(config *controllerConfig, debug bool) (*unifiClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs: config.RootCAs,
+	}
+	if len(config.SSLFingerprint) > 0 {
+		// the certificate is pinned, it does not need to be signed by a trusted ca
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate present")
+			}
+			hash := sha1.Sum(rawCerts[0])
+			if !bytes.Equal(hash[:], config.SSLFingerprint) {
+				return fmt.Errorf("ssl fingerprint mismatch: expected %x got %x", config.SSLFingerprint, hash)
+			}
+			return nil
+		}
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	return &unifiClient{
+		config:    config,
+		debug:     debug,
+		urls:      append([]string{config.URL}, config.FailoverURLs...),
+		tlsConfig: tlsConfig,
+		now:       time.Now,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+				IdleConnTimeout: 90 * time.Second,
+			},
+			Jar:     jar,
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+// detect checks whether the controller is an UniFi OS console.
+// UniFi OS consoles answer the root page directly, standalone controllers redirect to /manage.
+func (u *unifiClient) detect(ctx context.Context) error {
+	if u.detected {
+		return nil
+	}
+
+	switch u.config.Type {
+	case controllerLegacy:
+		u.unifiOS, u.detected = false, true
+		return nil
+	case controllerUnifiOS:
+		u.unifiOS, u.detected = true, true
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.urls[u.active]+"/", nil)
+	if err != nil {
+		return fmt.Errorf("unable to create detect request: %w", err)
+	}
+
+	noRedirect := *u.client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	res, err := noRedirect.Do(req)
+	if err != nil {
+		return endpointError{fmt.Errorf("unable to perform detect request: %w", err)}
+	}
+
+	if res.Body != nil {
+		if err = res.Body.Close(); err != nil {
+			return fmt.Errorf("unable to close detect body: %w", err)
+		}
+	}
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return endpointError{fmt.Errorf("detect failed: got status %d", res.StatusCode)}
+	}
+
+	u.unifiOS, u.detected = res.StatusCode == http.StatusOK, true
+	if u.debug {
+		log.Printf("[unifi-names] controller is UniFi OS: %t\n", u.unifiOS)
+	}
+	return nil
+}
+
+// apiPrefix returns the path prefix of the network api.
+func (u *unifiClient) apiPrefix() string {
+	if u.unifiOS {
+		return "/proxy/network"
+	}
+	return ""
+}
+
+// newRequest creates a request and sets the session and authentication headers.
+func (u *unifiClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.urls[u.active]+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if u.csrfToken != "" {
+		req.Header.Set("X-CSRF-Token", u.csrfToken)
+	}
+	if u.config.useAPIKey() {
+		req.Header.Set("X-API-KEY", secret(u.config.APIKey, u.config.APIKeyFile))
+	}
+	return req, nil
+}
+
+// session makes sure the controller type is known and a session is present.
+func (u *unifiClient) session(ctx context.Context) error {
+	if err := u.detect(ctx); err != nil {
+		return err
+	}
+	if u.loggedIn || u.config.useAPIKey() {
+		return nil
+	}
+	return u.login(ctx)
+}
+
+// login authenticates with username and password.
+func (u *unifiClient) login(ctx context.Context) error {
+	if now := u.now(); now.Before(u.blockedUntil) {
+		return fmt.Errorf("not logging in to `%s' for %s: %w", u.config.URL, u.blockedUntil.Sub(now).Round(time.Second), errCircuitOpen)
+	}
+
+	loginPath, reCookie := "/api/login", reSetCookieToken
+	if u.unifiOS {
+		loginPath, reCookie = "/api/auth/login", reSetCookieOSToken
+	}
+
+	payload := map[string]string{
+		"username": secret(u.config.Username, u.config.UsernameFile),
+		"password": secret(u.config.Password, u.config.PasswordFile),
+	}
+	if len(u.config.TOTPSecret) > 0 {
+		if u.unifiOS {
+			payload["token"] = totp(u.config.TOTPSecret, u.now())
+		} else {
+			payload["ubic_2fa_token"] = totp(u.config.TOTPSecret, u.now())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(payload); err != nil {
+		return fmt.Errorf("unable to encode payload: %w", err)
+	}
+
+	u.csrfToken = ""
+	req, err := u.newRequest(ctx, http.MethodPost, loginPath, &buf)
+	if err != nil {
+		return fmt.Errorf("unable to create login request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Referer", u.urls[u.active]+"/login")
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return endpointError{fmt.Errorf("unable to perform login request: %w", err)}
+	}
+
+	if res.Body != nil {
+		if err = res.Body.Close(); err != nil {
+			return fmt.Errorf("unable to close login body: %w", err)
+		}
+	}
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return endpointError{fmt.Errorf("login failed: expected status 200 got %d", res.StatusCode)}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		u.rejectLogin()
+		err := fmt.Errorf("login failed: expected status 200 got %d", res.StatusCode)
+		if res.StatusCode == http.StatusTooManyRequests {
+			return newThrottledError(err, res)
+		}
+		return err
+	}
+
+	matches := reCookie.FindStringSubmatch(res.Header.Get("Set-Cookie"))
+	if len(matches) != 2 {
+		return fmt.Errorf("login failed: invalid or no cookie")
+	}
+
+	// UniFi OS requires the csrf token on every following request
+	u.csrfToken = res.Header.Get("X-CSRF-Token")
+	if u.unifiOS && u.csrfToken == "" {
+		return fmt.Errorf("login failed: no csrf token")
+	}
+
+	if u.debug {
+		log.Println("[unifi-names] logged in")
+	}
+	u.loggedIn = true
+	u.rejectedLogins = 0
+	return nil
+}
+
+// rejectLogin counts a rejected login, the circuit breaker opens when the threshold is reached
+// so the account is not locked by repeated attempts.
+func (u *unifiClient) rejectLogin() {
+	u.rejectedLogins++
+	if threshold := u.config.BreakerThreshold; threshold > 0 && u.rejectedLogins >= threshold {
+		u.blockedUntil = u.now().Add(u.config.BreakerCooldown)
+		log.Printf("[unifi-names] %d logins to `%s' were rejected, pausing logins for %s\n", u.rejectedLogins, u.config.URL, u.config.BreakerCooldown)
+	}
+}
+
+// logout ends the session created by login.
+func (u *unifiClient) logout(ctx context.Context) error {
+	logoutPath := "/logout"
+	if u.unifiOS {
+		logoutPath = "/api/auth/logout"
+	}
+
+	req, err := u.newRequest(ctx, http.MethodPost, logoutPath, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create logout request: %w", err)
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to perform logout request: %w", err)
+	}
+
+	if res.Body != nil {
+		if err = res.Body.Close(); err != nil {
+			return fmt.Errorf("unable to close logout body: %w", err)
+		}
+	}
+
+	u.loggedIn = false
+	u.csrfToken = ""
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to logout: expected status 200 got %d", res.StatusCode)
+	}
+	return nil
+}
+
+// get fetches path from the network api and decodes the data field into v.
+// Transient failures (unreachable endpoints, 5xx and 429) are retried with backoff.
+func (u *unifiClient) get(ctx context.Context, path string, v interface{}) error {
+	for attempt := 1; ; attempt++ {
+		err := u.getOnce(ctx, path, v)
+		if err == nil || attempt >= u.config.RetryAttempts || ctx.Err() != nil {
+			return err
+		}
+		delay, ok := u.retryDelay(err, attempt)
+		if !ok {
+			return err
+		}
+		log.Printf("[unifi-names] request to `%s' failed: %v, retrying in %s\n", u.config.URL, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryDelay returns the delay before the next attempt of a request that failed with err,
+// it reports false if err is not transient or the controller asked for a longer delay than the maximum backoff.
+func (u *unifiClient) retryDelay(err error, attempt int) (time.Duration, bool) {
+	var endpointErr endpointError
+	var throttledErr throttledError
+	if !errors.As(err, &endpointErr) && !errors.As(err, &throttledErr) {
+		return 0, false
+	}
+
+	// exponential backoff with jitter, so several instances do not retry in lockstep
+	backoff := u.config.RetryMaxBackoff
+	if attempt < 32 {
+		if exp := u.config.RetryMinBackoff << (attempt - 1); exp > 0 && exp < backoff {
+			backoff = exp
+		}
+	}
+	delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	if throttledErr.retryAfter > u.config.RetryMaxBackoff {
+		return 0, false
+	}
+	if throttledErr.retryAfter > delay {
+		delay = throttledErr.retryAfter
+	}
+	return delay, true
+}
+
+// getOnce fetches path, if the session expired it logs in again and retries once,
+// if the endpoint fails the next endpoint is tried.
+func (u *unifiClient) getOnce(ctx context.Context, path string, v interface{}) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.reportEndpoint()
+	for i := 1; ; i++ {
+		err := u.getFromEndpoint(ctx, path, v)
+		var endpointErr endpointError
+		if !errors.As(err, &endpointErr) || i >= len(u.urls) {
+			return err
+		}
+		u.failover(err)
+	}
+}
+
+func (u *unifiClient) getFromEndpoint(ctx context.Context, path string, v interface{}) error {
+	if err := u.session(ctx); err != nil {
+		return err
+	}
+
+	err := u.fetch(ctx, path, v)
+	if !errors.Is(err, errLoginRequired) || u.config.useAPIKey() {
+		return err
+	}
+
+	if u.debug {
+		log.Println("[unifi-names] session expired, logging in again")
+	}
+	u.loggedIn = false
+	if err = u.session(ctx); err != nil {
+		return err
+	}
+	return u.fetch(ctx, path, v)
+}
+
+// failover switches to the next endpoint, the new endpoint needs a new session.
+func (u *unifiClient) failover(reason error) {
+	previous := u.urls[u.active]
+	u.active = (u.active + 1) % len(u.urls)
+	u.detected, u.loggedIn, u.csrfToken = false, false, ""
+	log.Printf("[unifi-names] endpoint `%s' failed: %v, switching to `%s'\n", previous, reason, u.urls[u.active])
+	failoverCount.WithLabelValues(u.config.URL).Inc()
+	u.reportEndpoint()
+}
+
+// reportEndpoint exports the active endpoint as metric.
+func (u *unifiClient) reportEndpoint() {
+	for i, url := range u.urls {
+		var active float64
+		if i == u.active {
+			active = 1
+		}
+		activeEndpoint.WithLabelValues(u.config.URL, url).Set(active)
+	}
+	if u.debug {
+		log.Printf("[unifi-names] active endpoint of `%s' is `%s'\n", u.config.URL, u.urls[u.active])
+	}
+}
+
+func (u *unifiClient) fetch(ctx context.Context, path string, v interface{}) error {
+	req, err := u.newRequest(ctx, http.MethodGet, u.apiPrefix()+path, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create %s request: %w", path, err)
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return endpointError{fmt.Errorf("unable to perform %s request: %w", path, err)}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return endpointError{fmt.Errorf("unable to get %s: expected status 200 got %d", path, res.StatusCode)}
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("unable to get %s: %w", path, errLoginRequired)
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return newThrottledError(fmt.Errorf("unable to get %s: expected status 200 got %d", path, res.StatusCode), res)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to get %s: expected status 200 got %d", path, res.StatusCode)
+	}
+
+	var envelope struct {
+		Meta struct {
+			RC  string
+			Msg string
+		}
+		Data json.RawMessage
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+
+	if envelope.Meta.Msg == "api.err.LoginRequired" {
+		return fmt.Errorf("unable to get %s: %w", path, errLoginRequired)
+	}
+
+	if envelope.Meta.RC != "" && envelope.Meta.RC != "ok" {
+		return fmt.Errorf("unable to get %s: %s", path, envelope.Meta.Msg)
+	}
+
+	if err = json.Unmarshal(envelope.Data, v); err != nil {
+		return fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// events opens the event stream of site, it uses the session of the client.
+func (u *unifiClient) events(ctx context.Context, site string) (*websocket.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.session(ctx); err != nil {
+		return nil, err
+	}
+
+	base := u.urls[u.active]
+	location, err := url.Parse(base + u.apiPrefix() + "/wss/s/" + site + "/events")
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse event stream url: %w", err)
+	}
+
+	config, err := websocket.NewConfig(strings.Replace(location.String(), "http", "ws", 1), base)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create event stream config: %w", err)
+	}
+	config.TlsConfig = u.tlsConfig
+	config.Dialer = &net.Dialer{Timeout: u.client.Timeout}
+	config.Header = http.Header{}
+	for _, cookie := range u.client.Jar.Cookies(location) {
+		config.Header.Add("Cookie", cookie.String())
+	}
+	if u.csrfToken != "" {
+		config.Header.Set("X-CSRF-Token", u.csrfToken)
+	}
+	if u.config.useAPIKey() {
+		config.Header.Set("X-API-KEY", secret(u.config.APIKey, u.config.APIKeyFile))
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		// the session might have expired, login again on the next attempt
+		var dialErr *websocket.DialError
+		if errors.As(err, &dialErr) && dialErr.Err == websocket.ErrBadStatus {
+			u.loggedIn = false
+		}
+		return nil, fmt.Errorf("unable to open event stream: %w", err)
+	}
+	return conn, nil
+}
+
+// close logs out of the controller (if there is a session) and releases idle connections.
+func (u *unifiClient) close(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	defer u.client.CloseIdleConnections()
+	if !u.loggedIn {
+		return nil
+	}
+	return u.logout(ctx)
+}
@@ -0,0 +1,361 @@
+package unifinames
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// negativeTTL is the maximum ttl of negative answers, it is low so new clients resolve soon after they connect.
+const negativeTTL = time.Minute
+
+// journalSize is the number of changes per zone that are kept for incremental zone transfers.
+const journalSize = 64
+
+// zoneSerial is the SOA serial of a zone and the records it was issued for.
+type zoneSerial struct {
+	serial uint32
+	digest uint64
+	// rrs are the records of the zone (without SOA and NS)
+	rrs []dns.RR
+	// journal holds the latest changes of the zone, the oldest first
+	journal []journalEntry
+}
+
+// journalEntry is a change of a zone from one serial to the next.
+type journalEntry struct {
+	from, to       uint32
+	deleted, added []dns.RR
+}
+
+// zones returns the zones the plugin is authoritative for: the configured and discovered domains
+// and the declared reverse zones.
+func (p *unifinames) zones() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.zonesLocked()
+}
+
+// zonesLocked is zones for callers that hold p.mu.
+func (p *unifinames) zonesLocked() []string {
+	zones := append(p.Config.domains(), p.Config.ReverseZones...)
+	for _, recs := range p.records {
+		zones = append(zones, recs.domains...)
+	}
+	return zones
+}
+
+// zone returns the closest zone of name the plugin is authoritative for, or an empty string if there is none.
+func (p *unifinames) zone(name string) string {
+	var closest string
+	for _, zone := range p.zones() {
+		if dns.IsSubDomain(zone, name) && (closest == "" || dns.CountLabel(zone) > dns.CountLabel(closest)) {
+			closest = zone
+		}
+	}
+	return closest
+}
+
+// available reports whether there are records for zone, they are missing if the controller
+// of the zone was not reached recently.
+func (p *unifinames) available(zone string) bool {
+	reverse := dns.IsSubDomain("in-addr.arpa.", zone) || dns.IsSubDomain("ip6.arpa.", zone)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, recs := range p.records {
+		if _, ok := p.ttl(recs); !ok {
+			continue
+		}
+		if reverse {
+			return true
+		}
+		for _, domain := range recs.domains {
+			if dns.IsSubDomain(zone, domain) || dns.IsSubDomain(domain, zone) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exists reports whether there is a record for name or for a name below it (an empty non-terminal).
+func (p *unifinames) exists(name, zone string) bool {
+	if strings.EqualFold(name, zone) {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, recs := range p.records {
+		if _, ok := p.ttl(recs); !ok {
+			continue
+		}
+		for _, rr := range recs.aClients {
+			if dns.IsSubDomain(name, rr.Hdr.Name) || isReverseOf(name, rr.A.String()) {
+				return true
+			}
+		}
+		for _, rr := range recs.aaaaClients {
+			if dns.IsSubDomain(name, rr.Hdr.Name) || isReverseOf(name, rr.AAAA.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isReverseOf reports whether name is the reverse name of address, or a name above it.
+func isReverseOf(name, address string) bool {
+	reverse, err := dns.ReverseAddr(address)
+	return err == nil && dns.IsSubDomain(name, reverse)
+}
+
+// updateSerials increases the serial of every zone whose records changed and journals the change,
+// p.mu must be held. A new serial is at least the current unix time, so the serials also increase across restarts.
+func (p *unifinames) updateSerials() {
+	if p.serials == nil {
+		p.serials = make(map[string]zoneSerial)
+	}
+	now := uint32(time.Now().Unix())
+	for _, zone := range p.zonesLocked() {
+		rrs := p.zoneRecords(zone)
+		digest := digest(rrs)
+		current, ok := p.serials[zone]
+		if ok && current.digest == digest {
+			continue
+		}
+		next := zoneSerial{serial: now, digest: digest, rrs: rrs}
+		if ok {
+			if current.serial >= next.serial {
+				next.serial = current.serial + 1
+			}
+			deleted, added := diff(current.rrs, rrs)
+			next.journal = append(current.journal, journalEntry{from: current.serial, to: next.serial, deleted: deleted, added: added})
+			if len(next.journal) > journalSize {
+				next.journal = next.journal[len(next.journal)-journalSize:]
+			}
+		}
+		p.serials[zone] = next
+		if p.Config.Transfer != nil && len(p.Config.Transfer.Notify) > 0 {
+			go p.notify(zone, next.serial)
+		}
+	}
+}
+
+// zoneRecords returns the records of zone without SOA and NS, ordered by their text form, p.mu must be held.
+// Forward zones hold the A and AAAA records, reverse zones the PTR records of the addresses in the zone.
+func (p *unifinames) zoneRecords(zone string) []dns.RR {
+	seen := make(map[string]bool)
+	var rrs []dns.RR
+	add := func(rr dns.RR) {
+		if key := rr.String(); !seen[key] {
+			seen[key] = true
+			rrs = append(rrs, rr)
+		}
+	}
+	addAddress := func(name string, ip net.IP, rr dns.RR) {
+		if dns.IsSubDomain(zone, name) {
+			add(rr)
+		}
+		if reverse, err := dns.ReverseAddr(ip.String()); err == nil && dns.IsSubDomain(zone, reverse) {
+			add(&dns.PTR{
+				Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: p.Config.TTL},
+				Ptr: name,
+			})
+		}
+	}
+	for _, recs := range p.records {
+		for _, rr := range recs.aClients {
+			a := rr
+			a.Hdr.Ttl = p.Config.TTL
+			addAddress(a.Hdr.Name, a.A, &a)
+		}
+		for _, rr := range recs.aaaaClients {
+			aaaa := rr
+			aaaa.Hdr.Ttl = p.Config.TTL
+			addAddress(aaaa.Hdr.Name, aaaa.AAAA, &aaaa)
+		}
+	}
+	// the controllers list the clients in no particular order
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].String() < rrs[j].String() })
+	return rrs
+}
+
+// digest returns a hash of rrs.
+func digest(rrs []dns.RR) uint64 {
+	h := fnv.New64a()
+	for _, rr := range rrs {
+		h.Write([]byte(rr.String()))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// diff returns the records of from that are not in to and the records of to that are not in from.
+func diff(from, to []dns.RR) (deleted, added []dns.RR) {
+	in := func(rrs []dns.RR) map[string]bool {
+		set := make(map[string]bool, len(rrs))
+		for _, rr := range rrs {
+			set[rr.String()] = true
+		}
+		return set
+	}
+	fromSet, toSet := in(from), in(to)
+	for _, rr := range from {
+		if !toSet[rr.String()] {
+			deleted = append(deleted, rr)
+		}
+	}
+	for _, rr := range to {
+		if !fromSet[rr.String()] {
+			added = append(added, rr)
+		}
+	}
+	return deleted, added
+}
+
+// nameServers returns the name servers of the zones, there are none unless NS or the mname of the SOA is set,
+// a made up name would not resolve and make the delegation lame.
+func (p *unifinames) nameServers() []string {
+	if len(p.Config.NS) > 0 {
+		return p.Config.NS
+	}
+	if p.Config.SOA.MName != "" {
+		return []string{p.Config.SOA.MName}
+	}
+	return nil
+}
+
+// hostname returns the fully qualified name of the machine, it is the mname of the SOA records
+// if neither the mname nor NS are set.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "localhost."
+	}
+	return dns.Fqdn(strings.ToLower(name))
+}
+
+// soa returns the SOA record of zone, the values that are not configured are derived from the refresh rate.
+func (p *unifinames) soa(zone string) *dns.SOA {
+	cfg := p.Config.SOA
+	mname := cfg.MName
+	if mname == "" {
+		mname = hostname()
+		if ns := p.nameServers(); len(ns) > 0 {
+			mname = ns[0]
+		}
+	}
+	rname := cfg.RName
+	if rname == "" {
+		rname = "hostmaster." + zone
+	}
+	// the global refresh rate
+	refresh := p.refreshInterval(&controllerConfig{})
+	if cfg.Refresh > 0 {
+		refresh = cfg.Refresh
+	}
+	retry := refresh / 4
+	if cfg.Retry > 0 {
+		retry = cfg.Retry
+	}
+	expire := refresh + p.Config.MaxStale
+	if cfg.Expire > 0 {
+		expire = cfg.Expire
+	}
+	minimum := time.Duration(p.Config.TTL) * time.Second
+	if minimum > negativeTTL {
+		minimum = negativeTTL
+	}
+	if cfg.Minimum > 0 {
+		minimum = cfg.Minimum
+	}
+
+	p.mu.Lock()
+	if _, ok := p.serials[zone]; !ok {
+		p.updateSerials()
+	}
+	serial := p.serials[zone].serial
+	p.mu.Unlock()
+
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    p.Config.TTL,
+		},
+		Ns:      mname,
+		Mbox:    rname,
+		Serial:  serial,
+		Refresh: uint32(refresh / time.Second),
+		Retry:   uint32(retry / time.Second),
+		Expire:  uint32(expire / time.Second),
+		Minttl:  uint32(minimum / time.Second),
+	}
+}
+
+// apex returns the SOA or NS records of zone.
+func (p *unifinames) apex(zone string, qtype uint16) []dns.RR {
+	if qtype == dns.TypeSOA {
+		return []dns.RR{p.soa(zone)}
+	}
+	var rrs []dns.RR
+	for _, ns := range p.nameServers() {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   zone,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    p.Config.TTL,
+			},
+			Ns: ns,
+		})
+	}
+	return rrs
+}
+
+// negative answers a query for a name in a zone the plugin is authoritative for that has no records,
+// with NXDOMAIN if the name does not exist and NODATA if it has no records of the type.
+// Queries outside the zones or in zones that fall through are passed to the next plugin,
+// if there are no records for the zone the query fails.
+func (p *unifinames) negative(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if len(r.Question) == 0 || r.Question[0].Qclass != dns.ClassINET {
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+	name := strings.ToLower(r.Question[0].Name)
+	zone := p.zone(name)
+	if zone == "" || p.Config.Fall.Through(name) {
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+
+	if !p.available(zone) {
+		// the names are unknown rather than absent
+		return dns.RcodeServerFailure, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if !p.exists(name, zone) {
+		m.Rcode = dns.RcodeNameError
+	}
+	// negative answers are cached for the minimum of the ttl and the minimum of the SOA (RFC 2308)
+	soa := p.soa(zone)
+	if soa.Hdr.Ttl > soa.Minttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	m.Ns = []dns.RR{soa}
+	if p.Config.Debug {
+		log.Printf("[unifi-names] Answering with %s for `%s'\n", dns.RcodeToString[m.Rcode], name)
+	}
+	w.WriteMsg(m)
+	return m.Rcode, nil
+}